@@ -0,0 +1,158 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"context"
+)
+
+// Projection converts the events of one flow into the events expected by
+// another.  See Adapt and PIPE.
+type Projection func(data EventData) EventData
+
+/*
+   Adapt returns a copy of the flow ending in the given State whose Tests,
+   Actions and Validator see each event as projected by up, allowing a flow
+   written for one kind of event to be composed into a flow driven by
+   another.  For example, given a flow that tests Shipment events,
+
+       Adapt(shipped, func(data EventData) EventData {
+           return data.(Order).Shipment
+       })
+
+   can be combined with flows that test Order events.  Given a position
+   inside a lazily evaluated AND, Adapt copies the rest of the flow from
+   that position, the same as Fork.
+
+   The adapted flow no longer shares its Tests with the flow it was adapted
+   from, so OR won't merge transitions of the adapted flow with transitions
+   of other flows that use the same Tests directly.  Transitions that use
+   the same Test within the adapted flow still share a Test.  Timeouts are
+   left as they are, since they see how long a run has waited rather than
+   events.  up must accept every event sent to the adapted flow, so if other
+   branches are driven by events that can't be projected, it should return
+   an event that the inner Tests reject.
+*/
+func Adapt(inner stateSource, up Projection) *State {
+	adapted := inner.state().copy()
+	adapted.root().adapt(up, new(adapter))
+	return adapted
+}
+
+// adapter remembers the Test adapted from each original Test, so that
+// transitions sharing a Test continue to do so once adapted.
+type adapter struct {
+	originals []Test
+	adapted   []Test
+}
+
+func (ad *adapter) test(test Test, up Projection) Test {
+	for i, original := range ad.originals {
+		if original == test {
+			return ad.adapted[i]
+		}
+	}
+	adapted := test
+	if _, ok := timeoutAfter(test); !ok {
+		// Timeouts are handed how long a run has waited rather than events,
+		// so they are kept as they are, along with their descriptors
+		adapted = NewTest(func(data EventData) bool {
+			return test.Pass(up(data))
+		})
+	}
+	ad.originals = append(ad.originals, test)
+	ad.adapted = append(ad.adapted, adapted)
+	return adapted
+}
+
+// adapt adapts every State of the flow starting at the given root in place.
+func (root *State) adapt(up Projection, ad *adapter) {
+	root.each(func(s *State) {
+		for _, trans := range s.out {
+			if !trans.test.isZero() {
+				trans.test = ad.test(trans.test, up)
+			}
+			if guard := trans.guard; guard != nil {
+				trans.guard = func(data EventData) bool {
+					return guard(up(data))
+				}
+			}
+			for i, hook := range trans.onEnter {
+				hook := hook
+				trans.onEnter[i] = func(data EventData) {
+					hook(up(data))
+				}
+			}
+		}
+		for i, action := range s.actions {
+			action := action
+			s.actions[i] = func(data EventData) {
+				action(up(data))
+			}
+		}
+		for i, action := range s.stateActions {
+			if action := action; action != nil {
+				s.stateActions[i] = func(state *State, data EventData) {
+					action(state, up(data))
+				}
+			}
+		}
+		for i, action := range s.contextActions {
+			if action := action; action != nil {
+				s.contextActions[i] = func(ctx context.Context, data EventData) error {
+					return action(ctx, up(data))
+				}
+			}
+		}
+		if !s.until.isZero() {
+			s.until = ad.test(s.until, up)
+		}
+		if validator := s.validator; validator != nil {
+			s.validator = func(data EventData) error {
+				return validator(up(data))
+			}
+		}
+		if equality := s.equality; equality != nil {
+			s.equality = func(a, b EventData) bool {
+				return equality(up(a), up(b))
+			}
+		}
+		for _, branch := range s.lazy {
+			branch.adapt(up, ad)
+		}
+	})
+}
+
+// ReplaceTest returns a copy of the flow ending in the given State in which
+// every transition whose Test is the same as old (see Keyer) uses
+// replacement instead, for example to switch a feature on or off.
+func (state *State) ReplaceTest(old Test, replacement Test) *State {
+	replaced := state.copy()
+	replaced.root().mapTests(func(test Test) Test {
+		if sameTest(test, old) {
+			return replacement
+		}
+		return test
+	})
+	return replaced
+}
+
+// mapTests replaces the Test of every transition of the flow starting at the
+// given root, other than epsilon transitions, and every Test waited on with
+// UNTIL with the result of the given function, in place.
+func (root *State) mapTests(f func(test Test) Test) {
+	root.each(func(s *State) {
+		for _, trans := range s.out {
+			if !trans.test.isZero() && !trans.epsilon {
+				trans.test = f(trans.test)
+			}
+		}
+		if !s.until.isZero() {
+			s.until = f(s.until)
+		}
+		for _, branch := range s.lazy {
+			branch.mapTests(f)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package gflow
+
+import (
+	"testing"
+	"time"
+)
+
+type shipment struct {
+	Status string
+}
+
+type order struct {
+	ID       int
+	Shipment shipment
+}
+
+func shipmentIs(status string) Test {
+	return NewTest(func(data EventData) bool {
+		return data.(shipment).Status == status
+	})
+}
+
+func TestAdapt(t *testing.T) {
+	var entered, delivered []shipment
+	shipped := shipmentIs("shipped").OnEnter(func(data EventData) {
+		entered = append(entered, data.(shipment))
+	}).THEN(shipmentIs("delivered")).DO(func(data EventData) {
+		delivered = append(delivered, data.(shipment))
+	})
+
+	placed := NewTest(func(data EventData) bool {
+		return data.(order).ID > 0
+	})
+	flow := placed.THEN(Adapt(shipped, func(data EventData) EventData {
+		return data.(order).Shipment
+	})).Build()
+
+	state := flow.Advance(order{ID: 1})
+	state = state.Advance(order{ID: 1, Shipment: shipment{"shipped"}})
+	state = state.Advance(order{ID: 1, Shipment: shipment{"delivered"}})
+	if !state.Finished() {
+		t.Errorf("adapted flow did not finish")
+	}
+	if len(delivered) != 1 || delivered[0].Status != "delivered" {
+		t.Errorf("expected action to see the projected event, got %v", delivered)
+	}
+	if len(entered) != 1 || entered[0].Status != "shipped" {
+		t.Errorf("expected OnEnter hook to see the projected event, got %v", entered)
+	}
+}
+
+func TestAdaptTimeout(t *testing.T) {
+	now := epoch
+	clock := func() time.Time {
+		return now
+	}
+	shipping := shipmentIs("shipped").OR(Timeout(time.Minute).THEN(shipmentIs("delayed")))
+	flow := Adapt(shipping, func(data EventData) EventData {
+		return data.(order).Shipment
+	}).Build()
+
+	run := flow.Run().Clock(clock)
+	now = now.Add(time.Hour)
+	timedOut := run.AdvanceClock()
+	if timedOut == flow || !timedOut.Advance(order{Shipment: shipment{"delayed"}}).Finished() {
+		t.Errorf("expected adapted timeout to fire")
+	}
+}
+
+func TestAdaptLazyPosition(t *testing.T) {
+	packed := shipmentIs("packed").LAZYAND(shipmentIs("labeled")).THEN(shipmentIs("shipped")).Build()
+	position := packed.Advance(shipment{"packed"})
+	adapted := Adapt(position, func(data EventData) EventData {
+		return data.(order).Shipment
+	}).Build()
+
+	state := adapted.Advance(order{Shipment: shipment{"labeled"}}).Advance(order{Shipment: shipment{"shipped"}})
+	if !state.Finished() {
+		t.Errorf("expected adapted position inside lazy AND to continue from there")
+	}
+	if adapted.Advance(order{Shipment: shipment{"packed"}}) != adapted {
+		t.Errorf("expected adapted position not to wait for the branch it already passed")
+	}
+}
+
+func TestAdaptSharedTests(t *testing.T) {
+	shipped := shipmentIs("shipped")
+	adapted := Adapt(shipped.THEN(shipped), func(data EventData) EventData {
+		return data.(order).Shipment
+	}).Build()
+
+	first := adapted.out[0]
+	if !sameTest(first.test, first.to.out[0].test) {
+		t.Errorf("expected adapted transitions to keep sharing their test")
+	}
+	event := order{Shipment: shipment{"shipped"}}
+	if !adapted.Advance(event).Advance(event).Finished() {
+		t.Errorf("expected adapted tests to pass projected events")
+	}
+}
+
+func TestReplaceTest(t *testing.T) {
+	enabled := a.THEN(b).OR(b.THEN(a)).Build()
+	disabled := enabled.ReplaceTest(a, Never).Build()
+	if !finishes(enabled, []string{A, B}) {
+		t.Errorf("expected original flow to be unchanged")
+	}
+	if finishes(disabled, []string{A, B}) || finishes(disabled, []string{B, A}) {
+		t.Errorf("expected replaced test to no longer pass")
+	}
+
+	replaced := enabled.ReplaceTest(a, c).Build()
+	if !finishes(replaced, []string{C, B}) || !finishes(replaced, []string{B, C}) {
+		t.Errorf("expected every use of the test to be replaced")
+	}
+	if keyed := Equals(A).THEN(b).ReplaceTest(Equals(A), c); !finishes(keyed, []string{C, B}) {
+		t.Errorf("expected tests to be matched by key")
+	}
+}
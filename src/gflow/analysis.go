@@ -0,0 +1,564 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Transition describes a transition between two States of a built flow.
+type Transition struct {
+	From   int
+	To     int
+	Test   Test
+	Source string
+}
+
+// Alphabet returns the distinct Tests (see Keyer) that the flow containing
+// the given State depends on, including those waited on with UNTIL, in the
+// order in which they are first encountered.  An event source must be able
+// to produce events passing each of these Tests to be able to drive the flow
+// through every transition.
+func (state *State) Alphabet() []Test {
+	var alphabet []Test
+	state.root().each(func(s *State) {
+		for _, trans := range s.out {
+			if !trans.test.isZero() && !containsTest(alphabet, trans.test) {
+				alphabet = append(alphabet, trans.test)
+			}
+		}
+		if !s.until.isZero() && !containsTest(alphabet, s.until) {
+			alphabet = append(alphabet, s.until)
+		}
+		for _, branch := range s.lazy {
+			for _, test := range branch.Alphabet() {
+				if !containsTest(alphabet, test) {
+					alphabet = append(alphabet, test)
+				}
+			}
+		}
+	})
+	return alphabet
+}
+
+// NextTests returns the Tests of the transitions that can be taken from the
+// given State, which are the Tests that an event must pass to advance the
+// flow.  For States reached within an AND, these are the Tests available on
+// the branches that are still pending, and for States with epsilon
+// transitions, those available anywhere in their closure.  Tests are listed
+// once each, in the order in which Advance tries them, including Tests of
+// transitions that require a permission.  The returned slice is a copy, so
+// changing it has no effect on the flow.
+func (state *State) NextTests() []Test {
+	var tests []Test
+	for _, trans := range state.moves() {
+		if !containsTest(tests, trans.test) {
+			tests = append(tests, trans.test)
+		}
+	}
+	return tests
+}
+
+// EntryTests returns the Tests that an event must pass to start the flow
+// containing the given State, which are the NextTests of its root.
+func (state *State) EntryTests() []Test {
+	return state.root().NextTests()
+}
+
+// containsTest checks whether the given Tests include the given Test.
+func containsTest(tests []Test, test Test) bool {
+	for _, t := range tests {
+		if sameTest(t, test) {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildStrict builds the flow the same as Build, but also checks that the
+// flow is deterministic and free of side effects.  It returns an error if any
+// State has two outbound transitions with the same Test or with Tests that
+// are declared to overlap by their Descriptors (see Overlapper), or if any
+// Test isn't declared to be pure (see Pure).
+func (state *State) BuildStrict() (*State, error) {
+	root := state.Build()
+	var err error
+	root.each(func(s *State) {
+		for i, trans := range s.out {
+			if err == nil && !trans.test.isZero() && !pure(trans.test) {
+				err = fmt.Errorf("state %d has a transition to state %d%s whose test isn't declared pure", s.ID, trans.to.ID, trans.provenance())
+			}
+			for _, other := range s.out[i+1:] {
+				if err == nil && !trans.test.isZero() && !other.test.isZero() && overlaps(trans.test, other.test) {
+					err = fmt.Errorf("state %d is not deterministic: transitions to states %d%s and %d%s have overlapping tests", s.ID, trans.to.ID, trans.provenance(), other.to.ID, other.provenance())
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// Ambiguity records a sample event that passes the Tests of more than one
+// outbound transition of a State.  See Validate.
+type Ambiguity struct {
+	State int
+	Event EventData
+	To    []int
+}
+
+// AmbiguityError is returned by Validate, listing every ambiguity found.
+type AmbiguityError struct {
+	Ambiguities []Ambiguity
+}
+
+func (err *AmbiguityError) Error() string {
+	descriptions := make([]string, len(err.Ambiguities))
+	for i, ambiguity := range err.Ambiguities {
+		descriptions[i] = fmt.Sprintf("state %d: event %#v passes the tests of transitions to states %v", ambiguity.State, ambiguity.Event, ambiguity.To)
+	}
+	return "ambiguous transitions: " + strings.Join(descriptions, "; ")
+}
+
+// Validate checks the built flow containing the given State for States with
+// outbound transitions whose Tests aren't mutually exclusive, by testing each
+// of the given sample events against the Tests of every State.  If any
+// sample passes the Tests of more than one outbound transition of a State,
+// Validate returns an *AmbiguityError listing each such State and sample.
+// Unlike BuildStrict, which relies on what Descriptors declare, Validate
+// runs the Tests themselves, so it finds only the ambiguities that the
+// samples happen to exercise.
+func (state *State) Validate(samples []EventData) error {
+	var ambiguities []Ambiguity
+	state.root().each(func(s *State) {
+		for _, data := range samples {
+			var to []int
+			for _, trans := range s.out {
+				if !trans.test.isZero() && !trans.epsilon && trans.test.Pass(data) {
+					to = append(to, trans.to.ID)
+				}
+			}
+			if len(to) > 1 {
+				ambiguities = append(ambiguities, Ambiguity{State: s.ID, Event: data, To: to})
+			}
+		}
+	})
+	if len(ambiguities) > 0 {
+		return &AmbiguityError{ambiguities}
+	}
+	return nil
+}
+
+// DeadTransitions returns the transitions of the built flow containing the
+// given State whose Tests are known never to pass any event, for example
+// All(Equals("x"), Not(Equals("x"))).  See Satisfiable.
+func (state *State) DeadTransitions() []Transition {
+	var dead []Transition
+	state.root().each(func(s *State) {
+		for _, trans := range s.out {
+			if !trans.test.isZero() && !canPass(trans.test) {
+				dead = append(dead, Transition{From: s.ID, To: trans.to.ID, Test: trans.test, Source: trans.source})
+			}
+		}
+	})
+	return dead
+}
+
+// SameAndGroup checks whether the States with the given IDs are both
+// positions within the same AND composition, meaning that they represent
+// different stages of interleaving the same anded flows.  The end of an AND,
+// where all of its flows have finished, is not part of its group.  Since OR
+// builds new States from its operands, the States of an AND combined using
+// OR don't belong to a group.
+func (root *State) SameAndGroup(idA, idB int) bool {
+	stateA, stateB := root.root().FindByID(idA), root.root().FindByID(idB)
+	return stateA != nil && stateB != nil && stateA.andGroup != nil && stateA.andGroup == stateB.andGroup
+}
+
+// randomWalkLimit is the maximum number of steps RandomAcceptingSequence
+// takes before giving up on reaching the end of a flow.
+const randomWalkLimit = 10000
+
+// RandomAcceptingSequence walks the flow containing the given State from its
+// root to a finished State, choosing among the outbound transitions of each
+// State at random, and returns the Tests of the transitions taken.  Sending
+// the flow one event passing each Test in turn finishes the flow, which makes
+// the sequences useful for fuzzing actions.  It returns nil if the walk
+// doesn't finish within a fixed number of steps.
+func (state *State) RandomAcceptingSequence(r *rand.Rand) []Test {
+	current := state.root()
+	var sequence []Test
+	for !current.Finished() {
+		moves := current.moves()
+		if len(moves) == 0 || len(sequence) == randomWalkLimit {
+			return nil
+		}
+		trans := moves[r.Intn(len(moves))]
+		sequence = append(sequence, trans.test)
+		current = trans.to
+	}
+	return sequence
+}
+
+// MaxAndWidth returns the largest number of flows combined by a single AND
+// (or LAZYAND) within the flow containing the given State, which is the
+// largest number of branches that can be pending at once while advancing.
+// It returns 0 if the flow contains no AND.  Unlike SameAndGroup, it also
+// counts ANDs combined using OR, whose transitions OR copies into new States.
+func (state *State) MaxAndWidth() int {
+	width := 0
+	widen := func(w int) {
+		if w > width {
+			width = w
+		}
+	}
+	state.root().each(func(s *State) {
+		widen(len(s.andedStates))
+		if s.andGroup != nil {
+			widen(len(s.andGroup.andedStates))
+		}
+		widen(len(s.lazy))
+		for _, trans := range s.out {
+			widen(trans.andWidth)
+		}
+		for _, branch := range s.lazy {
+			widen(branch.MaxAndWidth())
+		}
+	})
+	return width
+}
+
+// VerifyAndCompletion checks that the end of every AND in the built flow
+// containing the given State can only be reached once each of the AND's
+// flows has been sent enough events to finish.  It returns an error naming
+// the end of the first AND that can be reached sooner.  Lazily evaluated
+// ANDs, which don't build their interleavings, and ANDs combined using OR,
+// whose States OR builds anew, aren't checked.
+func (state *State) VerifyAndCompletion() error {
+	var err error
+	state.root().each(func(end *State) {
+		if err != nil || len(end.andedStates) == 0 {
+			return
+		}
+		required := 0
+		for _, anded := range end.andedStates {
+			required += shortestDistance(anded.root(), (*State).Finished, func(trans *transition) bool {
+				return true
+			})
+		}
+		inAnd := func(trans *transition) bool {
+			return trans.to == end || trans.to.andGroup == end
+		}
+		check := func(from *State, actual int) {
+			if err == nil && actual >= 0 && actual < required {
+				err = fmt.Errorf("AND ending at state %d can finish after %d events from state %d, but its flows need at least %d", end.ID, actual, from.ID, required)
+			}
+		}
+		end.root().each(func(s *State) {
+			if s.andGroup == end {
+				if len(s.in) == 0 {
+					// s starts the AND at the root of the flow
+					check(s, shortestDistance(s, isState(end), inAnd))
+				}
+				return
+			}
+			for _, entry := range s.out {
+				if entry.to.andGroup == end {
+					// entry leads into the interleavings of the AND
+					if distance := shortestDistance(entry.to, isState(end), inAnd); distance >= 0 {
+						check(s, 1+distance)
+					}
+				}
+			}
+		})
+	})
+	return err
+}
+
+// isState returns a function checking whether a State is the given State.
+func isState(state *State) func(*State) bool {
+	return func(s *State) bool {
+		return s == state
+	}
+}
+
+// shortestDistance returns the smallest number of tested transitions that
+// must be taken to get from the given State to a State for which stop is
+// true, following only transitions for which follow is true.  Untested
+// transitions don't count towards the distance, except that crossing a
+// lazily evaluated AND counts the events its branches still need (see
+// lazySteps).  It returns -1 if no such State can be reached.
+func shortestDistance(from *State, stop func(*State) bool, follow func(*transition) bool) int {
+	distances := map[*State]int{from: 0}
+	reached := make(map[*State]bool)
+	pending := []distanceTo{{from, 0}}
+	for len(pending) > 0 {
+		current := pending[0].state
+		pending = pending[1:]
+		if reached[current] {
+			continue
+		}
+		reached[current] = true
+		if stop(current) {
+			return distances[current]
+		}
+		for _, trans := range current.out {
+			if !follow(trans) {
+				continue
+			}
+			steps := 0
+			switch {
+			case current.lazy != nil && trans == current.lazyLink():
+				steps = current.lazySteps()
+				if steps < 0 {
+					continue
+				}
+			case !trans.test.isZero():
+				steps = 1
+			}
+			distance := distances[current] + steps
+			if known, ok := distances[trans.to]; !ok || distance < known {
+				distances[trans.to] = distance
+				// Keep pending ordered by distance, so that each State is
+				// reached along its shortest path first
+				i := sort.Search(len(pending), func(i int) bool {
+					return pending[i].distance > distance
+				})
+				pending = append(pending[:i], append([]distanceTo{{trans.to, distance}}, pending[i:]...)...)
+			}
+		}
+	}
+	return -1
+}
+
+// distanceTo is a State waiting to be visited by shortestDistance along with
+// its distance at the time.
+type distanceTo struct {
+	state    *State
+	distance int
+}
+
+// StepsToFinish returns the smallest number of events needed to advance from
+// the given State to a finished State, or -1 if no finished State can be
+// reached.  Barriers are counted as though each event advanced only one of
+// their source flows, so the result for a flow containing a barrier may be
+// higher than the number of events actually needed.
+func (state *State) StepsToFinish() int {
+	return shortestDistance(state, (*State).Finished, func(trans *transition) bool {
+		return true
+	})
+}
+
+// Accepts checks whether the flow containing the given State finishes when
+// sent, from its root, one event passing each of the given Tests in turn,
+// assuming that each event passes only the Tests that are the same as its
+// own (see Keyer).  Where several transitions from a State have the same
+// Test, Accepts follows all of them, so the flow accepts the Tests if any
+// of the paths finishes.
+func (state *State) Accepts(tests []Test) bool {
+	current := []*State{state.root()}
+	for _, test := range tests {
+		var next []*State
+		for _, s := range current {
+			for _, trans := range s.moves() {
+				if !trans.test.isZero() && sameTest(trans.test, test) && !containsState(next, trans.to) {
+					next = append(next, trans.to)
+				}
+			}
+		}
+		current = next
+	}
+	for _, s := range current {
+		if s.Finished() {
+			return true
+		}
+	}
+	return false
+}
+
+// containsState checks whether the given States include the given State.
+func containsState(states []*State, state *State) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptingPaths returns every distinct sequence of at most maxLen Tests
+// along which the flow containing the given State leads from its root to a
+// finished State, for example to document the flow or to generate cases for
+// property tests.  Sending the flow one event passing each Test of a
+// sequence in turn finishes it, as with RandomAcceptingSequence.  Sequences
+// are listed in the order in which a depth-first walk of the flow reaches
+// their ends, so a.OR(b) has the paths [a] and [b], and a.AND(b) has the
+// paths [a b] and [b a].  The number of paths can grow quickly with maxLen
+// in flows that combine many ANDs or repeat.
+func (state *State) AcceptingPaths(maxLen int) [][]Test {
+	var paths [][]Test
+	var walk func(s *State, path []Test)
+	walk = func(s *State, path []Test) {
+		if s.Finished() {
+			if !containsPath(paths, path) {
+				paths = append(paths, append([]Test(nil), path...))
+			}
+			return
+		}
+		if len(path) == maxLen {
+			return
+		}
+		for _, trans := range s.moves() {
+			walk(trans.to, append(path, trans.test))
+		}
+	}
+	walk(state.root(), nil)
+	return paths
+}
+
+// containsPath checks whether the given sequences of Tests include one that
+// is the same as path, Test for Test.
+func containsPath(paths [][]Test, path []Test) bool {
+	for _, p := range paths {
+		if len(p) != len(path) {
+			continue
+		}
+		same := true
+		for i := range p {
+			if !sameTest(p[i], path[i]) {
+				same = false
+				break
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// ShadowedBranches returns the IDs of the States at which OR dropped part of
+// one of its branches because both branches start with the same Test there
+// and only one of them finishes on it.  The branch that finishes wins (see
+// Weight), so in a.OR(a.THEN(c)) an A always finishes the flow and the C of
+// the second branch can never be reached.  The result is ordered by ID and
+// is only meaningful once the flow has been built.
+func (state *State) ShadowedBranches() []int {
+	var ids []int
+	state.root().each(func(s *State) {
+		if s.shadows {
+			ids = append(ids, s.ID)
+		}
+	})
+	sort.Ints(ids)
+	return ids
+}
+
+// Walk calls visit once for every State of the flow containing the given
+// State, starting at its root and following transitions depth first, and
+// returns the number of States visited.  States where branches join, such
+// as the ends of ORs and ANDs, are visited only once however many
+// transitions reach them, so visiting the outbound transitions of each State
+// visits every transition exactly once.  Lazily evaluated branches aren't
+// followed.
+func (state *State) Walk(visit func(s *State)) int {
+	count := 0
+	state.root().each(func(s *State) {
+		count++
+		visit(s)
+	})
+	return count
+}
+
+// StateCount returns the number of distinct States of the flow containing
+// the given State, counting States where branches join only once, unlike
+// the number of paths through the flow, which grows quickly with ANDs.  See
+// Walk.
+func (state *State) StateCount() int {
+	return state.Walk(func(s *State) {})
+}
+
+// InDegrees maps the ID of each State of the built flow containing the given
+// State to its number of inbound transitions.  States with more than one are
+// the points at which branches of the flow join, such as the ends of ORs and
+// ANDs.  States created while advancing through a lazily evaluated AND are
+// not part of the built flow, so they aren't included.
+func (state *State) InDegrees() map[int]int {
+	degrees := make(map[int]int)
+	state.root().each(func(s *State) {
+		degrees[s.ID] = len(s.in)
+	})
+	return degrees
+}
+
+// Actions maps the ID of each State of the built flow containing the given
+// State that has actions (see DO) to its action.  Actions are compared by
+// pointer, so an action registered on the same State more than once counts
+// once, and one reused on several States is the same Action for each.  A
+// State with several different actions maps to an Action that calls each of
+// them in the order in which they fire.  OnEnter hooks belong to transitions
+// rather than States, so they aren't included.
+func (state *State) Actions() map[int]Action {
+	actions := make(map[int]Action)
+	state.root().each(func(s *State) {
+		var distinct []Action
+		for _, action := range s.actions {
+			if !containsAction(distinct, action) {
+				distinct = append(distinct, action)
+			}
+		}
+		switch len(distinct) {
+		case 0:
+		case 1:
+			actions[s.ID] = distinct[0]
+		default:
+			actions[s.ID] = func(data EventData) {
+				for _, action := range distinct {
+					action(data)
+				}
+			}
+		}
+	})
+	return actions
+}
+
+// containsAction checks whether the given Actions include the given Action,
+// comparing them by pointer, since functions can't be compared with ==.
+func containsAction(actions []Action, action Action) bool {
+	for _, a := range actions {
+		if reflect.ValueOf(a).Pointer() == reflect.ValueOf(action).Pointer() {
+			return true
+		}
+	}
+	return false
+}
+
+// DoubleCountPoints returns the IDs of the States that are reached by a
+// transition and left by another with the same Test, as in a.THEN(a).  Since
+// each event triggers only one transition, a single event never satisfies
+// both, and the flow waits for a second one at these States, which can come
+// as a surprise.  The result is ordered by ID and is only meaningful once
+// the flow has been built.
+func (state *State) DoubleCountPoints() []int {
+	var ids []int
+	state.root().each(func(s *State) {
+		for _, in := range s.in {
+			for _, out := range s.out {
+				if !in.test.isZero() && !out.test.isZero() && sameTest(in.test, out.test) {
+					if len(ids) == 0 || ids[len(ids)-1] != s.ID {
+						ids = append(ids, s.ID)
+					}
+				}
+			}
+		}
+	})
+	sort.Ints(ids)
+	return ids
+}
@@ -0,0 +1,436 @@
+package gflow
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// followTests follows the transitions using the given Tests, in turn, from
+// the given State, returning nil if there is no such transition.
+func followTests(state *State, tests []Test) *State {
+	for _, test := range tests {
+		var next *State
+		for _, trans := range state.moves() {
+			if trans.test == test {
+				next = trans.to
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		state = next
+	}
+	return state
+}
+
+func TestAlphabet(t *testing.T) {
+	flow := a.THEN(b).OR(a.AND(c)).THEN(d)
+	alphabet := flow.Alphabet()
+	if len(alphabet) != 4 {
+		t.Errorf("expected alphabet of 4 tests, got %d", len(alphabet))
+	}
+	for _, test := range []Test{a, b, c, d} {
+		if !containsTest(alphabet, test) {
+			t.Errorf("alphabet is missing a test")
+		}
+	}
+
+	if len(a.LAZYAND(b).LAZYAND(a).Alphabet()) != 2 {
+		t.Errorf("expected alphabet of lazy AND to contain its branches' tests")
+	}
+}
+
+func TestDeadTransitions(t *testing.T) {
+	unsatisfiable := All(Equals("x"), Not(Equals("x")))
+	flow := a.THEN(unsatisfiable).THEN(b).Build()
+
+	dead := flow.DeadTransitions()
+	if len(dead) != 1 {
+		t.Fatalf("expected 1 dead transition, got %d", len(dead))
+	}
+	if dead[0].From != 2 || dead[0].To != 3 || dead[0].Test != unsatisfiable {
+		t.Errorf("unexpected dead transition %v", dead[0])
+	}
+
+	if len(All(Equals("x"), Equals("y")).state().Build().DeadTransitions()) != 1 {
+		t.Errorf("expected a test requiring two different values to be dead")
+	}
+	if len(a.THEN(All(Equals("x"), Not(Equals("y")))).Build().DeadTransitions()) != 0 {
+		t.Errorf("expected no dead transitions for satisfiable tests")
+	}
+	if len(a.THEN(b).Build().DeadTransitions()) != 0 {
+		t.Errorf("expected no dead transitions for undescribed tests")
+	}
+}
+
+func TestSameAndGroup(t *testing.T) {
+	// 1 --a--> 2 --b--> 3
+	// 1 --b--> 4 --a--> 5
+	flow := a.AND(b).Build()
+	end := flow.Advance(A).Advance(B).ID
+	for _, pair := range [][2]int{{1, 2}, {1, 4}, {2, 4}} {
+		if !flow.SameAndGroup(pair[0], pair[1]) {
+			t.Errorf("expected states %d and %d to be in the same AND group", pair[0], pair[1])
+		}
+	}
+	if flow.SameAndGroup(1, end) {
+		t.Errorf("expected end of AND not to be in its group")
+	}
+
+	flow = a.AND(b).THEN(c.AND(d)).Build()
+	first := flow.Advance(A).ID
+	second := flow.Advance(A).Advance(B).Advance(C).ID
+	if !flow.SameAndGroup(flow.ID, first) {
+		t.Errorf("expected AND group to survive THEN")
+	}
+	if flow.SameAndGroup(first, second) {
+		t.Errorf("expected states of different ANDs to be in different groups")
+	}
+}
+
+func TestRandomAcceptingSequence(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	flows := []*State{
+		a.THEN(b).OR(c.AND(d)).Build(),
+		a.AND(b.THEN(c)).AND(d).Build(),
+		a.LAZYAND(b.THEN(c)).THEN(d).Build(),
+	}
+	for _, flow := range flows {
+		for i := 0; i < 20; i++ {
+			sequence := flow.RandomAcceptingSequence(r)
+			if sequence == nil {
+				t.Fatalf("no sequence returned")
+			}
+			if end := followTests(flow, sequence); end == nil || !end.Finished() {
+				t.Errorf("sequence of %d tests was not accepted by the flow", len(sequence))
+			}
+		}
+	}
+}
+
+func TestAcceptingPaths(t *testing.T) {
+	names := func(paths [][]Test) string {
+		var names []string
+		for _, path := range paths {
+			var tests []string
+			for _, test := range path {
+				tests = append(tests, nameTest(test))
+			}
+			names = append(names, strings.Join(tests, " "))
+		}
+		return strings.Join(names, ", ")
+	}
+
+	paths := []struct {
+		flow   *State
+		maxLen int
+		paths  string
+	}{
+		{a.OR(b).Build(), 5, "a, b"},
+		{a.AND(b).Build(), 5, "a b, b a"},
+		{a.THEN(b).OR(c).Build(), 5, "a b, a c, c"},
+		{a.THEN(b).OR(c).Build(), 1, "c"},
+		{a.AND(b).Build(), 1, ""},
+		{a.LAZYAND(b).Build(), 2, "a b, b a"},
+	}
+	for _, p := range paths {
+		if got := names(p.flow.AcceptingPaths(p.maxLen)); got != p.paths {
+			t.Errorf("expected paths %q of at most %d tests, got %q", p.paths, p.maxLen, got)
+		}
+	}
+
+	flow := a.AND(b).AND(c).Build()
+	accepting := flow.AcceptingPaths(3)
+	if len(accepting) != 6 {
+		t.Errorf("expected every ordering of three tests, got %s", names(accepting))
+	}
+	for _, path := range accepting {
+		if !flow.Accepts(path) {
+			t.Errorf("expected flow to accept path %s", names([][]Test{path}))
+		}
+	}
+}
+
+func TestMaxAndWidth(t *testing.T) {
+	widths := []struct {
+		label string
+		flow  *State
+		width int
+	}{
+		{"a.THEN(b).OR(c)", a.THEN(b).OR(c), 0},
+		{"a.AND(b)", a.AND(b), 2},
+		{"a.AND(b).AND(c)", a.AND(b).AND(c), 3},
+		{"a.AND(b).THEN(c.AND(d).AND(a))", a.AND(b).THEN(c.AND(d).AND(a)), 3},
+		{"a.LAZYAND(b).LAZYAND(c)", a.LAZYAND(b).LAZYAND(c), 3},
+		{"a.AND(b).OR(c)", a.AND(b).OR(c), 2},
+		{"d.OR(a.AND(b).AND(c))", d.OR(a.AND(b).AND(c)), 3},
+	}
+	for _, w := range widths {
+		if width := w.flow.Build().MaxAndWidth(); width != w.width {
+			t.Errorf("%s has width %d, expected %d", w.label, width, w.width)
+		}
+	}
+}
+
+func TestVerifyAndCompletion(t *testing.T) {
+	flows := []*State{
+		a.AND(b),
+		a.AND(b).AND(c),
+		a.THEN(b).AND(c.AND(d)),
+		d.THEN(a.OR(b.THEN(c)).AND(c)),
+		a.LAZYAND(b),
+	}
+	for _, flow := range flows {
+		if err := flow.Build().VerifyAndCompletion(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	// Wire up a shortcut from part way through a nested AND to its end
+	flow := a.THEN(b).AND(c.AND(d)).Build()
+	end := flow.Advance(A).Advance(B).Advance(C).Advance(D)
+	shortcut := &transition{test: d}
+	flow.Advance(A).addOut(shortcut)
+	end.addIn(shortcut)
+	if !end.Finished() || flow.VerifyAndCompletion() == nil {
+		t.Errorf("expected error for AND that finishes early")
+	}
+}
+
+func TestStepsToFinish(t *testing.T) {
+	state := a.THEN(b).THEN(c).Build()
+	for expected := 3; expected >= 0; expected-- {
+		if steps := state.StepsToFinish(); steps != expected {
+			t.Errorf("expected %d steps to finish, got %d", expected, steps)
+		}
+		state = state.Advance([]string{A, B, C, D}[3-expected])
+	}
+
+	flow := a.AND(b.THEN(c)).Build()
+	paths := map[string]int{"": 3, "A": 2, "B": 2, "BA": 1, "BC": 1, "BCA": 0}
+	for path, expected := range paths {
+		state := flow
+		for _, event := range path {
+			state = state.Advance(string(event))
+		}
+		if steps := state.StepsToFinish(); steps != expected {
+			t.Errorf("expected %d steps to finish after %q, got %d", expected, path, steps)
+		}
+	}
+
+	if steps := a.OR(a.THEN(b).THEN(c)).LAZYAND(d).Build().StepsToFinish(); steps != 2 {
+		t.Errorf("expected 2 steps to finish lazy AND, got %d", steps)
+	}
+
+	// Built eagerly, this AND would need 12! interleavings.
+	wide := makeTest("0").state()
+	for i := 1; i < 12; i++ {
+		wide = wide.LAZYAND(makeTest(strconv.Itoa(i)))
+	}
+	state = wide.THEN(a).Build().Advance("3")
+	if steps := state.StepsToFinish(); steps != 12 {
+		t.Errorf("expected 12 steps to finish wide lazy AND, got %d", steps)
+	}
+	if steps := b.Fallback(c.THEN(d)).Build().Advance(C).StepsToFinish(); steps != 1 {
+		t.Errorf("expected 1 step to finish Fallback, got %d", steps)
+	}
+
+	// Build can't number cyclic flows, so link one up by hand
+	loop := []*State{new(State), new(State), new(State)}
+	for i, link := range [][2]int{{0, 1}, {1, 2}, {2, 1}} {
+		trans := &transition{test: []Test{a, b, c}[i]}
+		loop[link[0]].addOut(trans)
+		loop[link[1]].addIn(trans)
+	}
+	if steps := loop[0].StepsToFinish(); steps != -1 {
+		t.Errorf("expected no way to finish loop, got %d", steps)
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	flow := a.THEN(b).OR(a.THEN(c)).OR(d.AND(b)).Build()
+	for _, tests := range [][]Test{{a, b}, {a, c}, {d, b}, {b, d}} {
+		if !flow.Accepts(tests) {
+			t.Errorf("expected flow to accept %d tests", len(tests))
+		}
+	}
+	for _, tests := range [][]Test{{a}, {b, c}, {a, b, c}, {}} {
+		if flow.Accepts(tests) {
+			t.Errorf("expected flow to reject %d tests", len(tests))
+		}
+	}
+}
+
+func TestShadowedBranches(t *testing.T) {
+	flow := a.OR(a.THEN(c)).Build()
+	if shadowed := flow.ShadowedBranches(); len(shadowed) != 1 || shadowed[0] != flow.ID {
+		t.Errorf("expected shadowed branch at root %d, got %v", flow.ID, shadowed)
+	}
+	nested := b.THEN(a.OR(a.THEN(c))).OR(d).Build()
+	if shadowed := nested.ShadowedBranches(); len(shadowed) != 1 || shadowed[0] != nested.Advance(B).ID {
+		t.Errorf("expected shadowed branch after B, got %v", shadowed)
+	}
+	if shadowed := a.THEN(c).OR(a.THEN(d)).Build().ShadowedBranches(); len(shadowed) != 0 {
+		t.Errorf("expected no shadowed branches, got %v", shadowed)
+	}
+}
+
+func TestDoubleCountPoints(t *testing.T) {
+	flow := a.THEN(a).THEN(b).Build()
+	if points := flow.DoubleCountPoints(); len(points) != 1 || points[0] != flow.Advance(A).ID {
+		t.Errorf("expected repeated test after the first A, got %v", points)
+	}
+	triple := a.THEN(a).THEN(a).Build()
+	if points := triple.DoubleCountPoints(); len(points) != 2 || points[0] != 2 || points[1] != 3 {
+		t.Errorf("expected repeated tests at States 2 and 3, got %v", points)
+	}
+	if points := a.THEN(b).THEN(a).Build().DoubleCountPoints(); len(points) != 0 {
+		t.Errorf("expected no repeated tests, got %v", points)
+	}
+}
+
+func TestEntryTests(t *testing.T) {
+	if entry := a.OR(b).Build().EntryTests(); len(entry) != 2 || entry[0] != a || entry[1] != b {
+		t.Errorf("expected a and b to start the flow, got %d tests", len(entry))
+	}
+	flow := a.THEN(b).Build()
+	if entry := flow.Advance(A).EntryTests(); len(entry) != 1 || entry[0] != a {
+		t.Errorf("expected only a to start the flow, got %d tests", len(entry))
+	}
+}
+
+func TestNextTests(t *testing.T) {
+	flow := a.THEN(b).OR(c).Build()
+	if next := flow.NextTests(); len(next) != 2 || next[0] != a || next[1] != c {
+		t.Errorf("expected a and c to be next, got %d tests", len(next))
+	}
+	if next := flow.Advance(A).NextTests(); len(next) != 2 || next[0] != b || next[1] != c {
+		t.Errorf("expected b and c to be next after A, got %d tests", len(next))
+	}
+	if next := flow.Advance(C).NextTests(); len(next) != 0 {
+		t.Errorf("expected no tests once finished, got %d", len(next))
+	}
+
+	anded := a.AND(b.THEN(c)).Build().Advance(B)
+	if next := anded.NextTests(); len(next) != 2 || next[0] != a || next[1] != c {
+		t.Errorf("expected pending branches of AND to offer a and c, got %d tests", len(next))
+	}
+	lazy := a.LAZYAND(b.THEN(c)).Build().Advance(B)
+	if next := lazy.NextTests(); len(next) != 2 || next[0] != a || next[1] != c {
+		t.Errorf("expected pending branches of lazy AND to offer a and c, got %d tests", len(next))
+	}
+
+	next := flow.NextTests()
+	next[0] = d
+	if flow.NextTests()[0] != a {
+		t.Errorf("expected changing the returned tests to leave the flow unchanged")
+	}
+}
+
+func TestInDegrees(t *testing.T) {
+	flow := a.THEN(b).OR(c).Build()
+	end := flow.Advance(C)
+	if degrees := flow.InDegrees(); degrees[flow.ID] != 0 || degrees[end.ID] != 3 || degrees[flow.Advance(A).ID] != 1 {
+		t.Errorf("expected shared end of OR to have three inbound transitions, got %v", degrees)
+	}
+
+	chain := a.THEN(b).THEN(c).Build()
+	degrees := chain.InDegrees()
+	if len(degrees) != 4 {
+		t.Errorf("expected four states, got %v", degrees)
+	}
+	for id, degree := range degrees {
+		if id != chain.ID && degree != 1 {
+			t.Errorf("expected state %d of chain to have one inbound transition, got %d", id, degree)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	flow := a.AND(b).Build()
+	visits := make(map[int]int)
+	count := flow.Advance(A).Walk(func(s *State) {
+		visits[s.ID]++
+	})
+	if count != 4 || len(visits) != 4 {
+		t.Errorf("expected walk to visit each of four states, got %d visits of %v", count, visits)
+	}
+	for id, n := range visits {
+		if n != 1 {
+			t.Errorf("expected state %d to be visited once, got %d", id, n)
+		}
+	}
+
+	nested := a.AND(b).AND(c).Build()
+	count = nested.Walk(func(s *State) {})
+	if count != len(nested.InDegrees()) || count >= nested.countChildren() {
+		t.Errorf("expected walk to count distinct states, got %d of %d (%d paths)", count, len(nested.InDegrees()), nested.countChildren())
+	}
+}
+
+func TestStateCount(t *testing.T) {
+	if count := a.THEN(b).Build().StateCount(); count != 3 {
+		t.Errorf("expected three states in chain, got %d", count)
+	}
+	flow := a.AND(b).AND(c).Build()
+	if count := flow.StateCount(); count != 11 || count == flow.countChildren() {
+		t.Errorf("expected eleven distinct states, got %d (%d counted with repeats)", count, flow.countChildren())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	samples := []EventData{A, B, C, D}
+	if err := a.THEN(b).OR(c).Build().Validate(samples); err != nil {
+		t.Errorf("unexpected error for mutually exclusive tests: %s", err)
+	}
+
+	flow := branches(Always, a)
+	err := flow.Validate(samples)
+	ambiguous, ok := err.(*AmbiguityError)
+	if !ok || len(ambiguous.Ambiguities) != 1 {
+		t.Fatalf("expected one ambiguity, got %v", err)
+	}
+	if ambiguity := ambiguous.Ambiguities[0]; ambiguity.State != flow.ID || ambiguity.Event != A || len(ambiguity.To) != 2 {
+		t.Errorf("expected A to be ambiguous at the root, got %+v", ambiguity)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("state %d", flow.ID)) {
+		t.Errorf("expected error to name the ambiguous state, got %q", err)
+	}
+}
+
+func TestActions(t *testing.T) {
+	var fired []string
+	audit := func(data EventData) {
+		fired = append(fired, "audit")
+	}
+	notify := func(data EventData) {
+		fired = append(fired, "notify")
+	}
+	flow := a.THEN(b).OR(c).DO(audit).DO(notify).DO(audit).Build()
+	end := flow.Advance(C)
+	actions := flow.Actions()
+	if len(actions) != 1 || actions[end.ID] == nil {
+		t.Fatalf("expected an action at the end, got %v", actions)
+	}
+	fired = nil
+	actions[end.ID](nil)
+	if strings.Join(fired, ",") != "audit,notify" {
+		t.Errorf("expected audit once and then notify, got %v", fired)
+	}
+
+	branched := a.state().DO(audit).THEN(b.state().DO(audit)).Build()
+	actions = branched.Actions()
+	afterA := branched.Advance(A)
+	afterB := afterA.Advance(B)
+	if len(actions) != 2 || actions[afterA.ID] == nil || actions[afterB.ID] == nil {
+		t.Fatalf("expected actions on two states, got %v", actions)
+	}
+	if reflect.ValueOf(actions[afterA.ID]).Pointer() != reflect.ValueOf(audit).Pointer() || reflect.ValueOf(actions[afterB.ID]).Pointer() != reflect.ValueOf(audit).Pointer() {
+		t.Errorf("expected the reused action on both states")
+	}
+}
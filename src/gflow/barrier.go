@@ -0,0 +1,80 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+/*
+   Barrier constructs a join barrier, a State that is reached only once every
+   one of the given source flows has reached it.
+
+   Unlike AND, which interleaves its flows so that each event advances only
+   one of them, a barrier offers every event to all of its source flows at
+   once, and each source flow that accepts the event advances.  This suits
+   flows whose paths watch the same stream of events independently, for
+   example waiting for both a payment and a shipment to be confirmed when
+   either may be confirmed by the same event.
+
+   Like LAZYAND, a barrier keeps a cursor into each source flow while
+   advancing.  Each position inside a barrier records which source flows
+   have arrived (see Arrived) for the run that reached it.  A source flow has
+   arrived once it is finished, whether or not it finished at one of its
+   intended ends (see Completed).
+
+   If one of the source flows never arrives, the barrier never proceeds and
+   the flow never finishes, no matter how many of the other source flows
+   have arrived.  Use Runner.Limit to bound how long a run may wait.
+
+   Combining a barrier using OR or AND builds it out in full as an AND, at
+   which point each event advances only one of its source flows.
+*/
+func Barrier(sources ...stateSource) *State {
+	// Create a common start node
+	start := new(State)
+	// Create a common end node
+	end := new(State)
+
+	start.barrier = true
+	start.kind, end.kind = KindBarrierStart, KindBarrierEnd
+	for _, source := range sources {
+		start.lazy = append(start.lazy, source.state().root())
+	}
+	link := &transition{from: start, to: end}
+	start.addOut(link)
+	end.addIn(link)
+
+	return end
+}
+
+// Arrived reports, for a State inside a barrier (see Barrier), which of the
+// barrier's source flows have reached it, in the order in which the sources
+// were given.  It returns nil for any other State.
+func (state *State) Arrived() []bool {
+	if !state.barrier {
+		return nil
+	}
+	arrived := make([]bool, len(state.lazy))
+	for i, branch := range state.lazy {
+		arrived[i] = branch.Finished()
+	}
+	return arrived
+}
+
+// stepBarrier finds the transition that the given EventData triggers from a
+// State inside a barrier by advancing every source cursor that accepts it.
+func (state *State) stepBarrier(data EventData, perms []string) *transition {
+	var first *transition
+	branches := state.lazy
+	for i, branch := range state.lazy {
+		branchTrans := branch.step(data, perms)
+		if branchTrans != nil {
+			if first == nil {
+				first = branchTrans
+			}
+			branches = replace(branches, i, branchTrans.to)
+		}
+	}
+	if first == nil {
+		return nil
+	}
+	return state.lazyTo(branches, first)
+}
@@ -0,0 +1,59 @@
+package gflow
+
+import (
+	"testing"
+)
+
+func TestBarrier(t *testing.T) {
+	flow := Barrier(a.THEN(b), c).Build()
+
+	state := flow.Advance(A).Advance(B)
+	if state.Finished() {
+		t.Errorf("barrier proceeded before every path arrived")
+	}
+	if arrived := state.Arrived(); len(arrived) != 2 || !arrived[0] || arrived[1] {
+		t.Errorf("expected only first path to have arrived, got %v", arrived)
+	}
+	if !state.Advance(C).Finished() {
+		t.Errorf("barrier did not proceed once both paths arrived")
+	}
+	if !finishes(flow, []string{C, A, B}) {
+		t.Errorf("barrier did not proceed when paths arrived in reverse order")
+	}
+	if flow.Arrived() == nil || a.THEN(b).Build().Arrived() != nil {
+		t.Errorf("expected only States inside a barrier to report arrivals")
+	}
+}
+
+func TestBarrierSharedEvents(t *testing.T) {
+	if !finishes(Barrier(a.THEN(b), a.THEN(c)), []string{A, B, C}) {
+		t.Errorf("expected one event to advance every path accepting it")
+	}
+	if finishes(a.THEN(b).AND(a.THEN(c)), []string{A, B, C}) {
+		t.Errorf("expected AND to advance only one path per event")
+	}
+}
+
+func TestBarrierNeverArrives(t *testing.T) {
+	if finishes(Barrier(a, b), []string{A, A, C, D}) {
+		t.Errorf("barrier proceeded although a path never arrived")
+	}
+}
+
+func TestBarrierTHEN(t *testing.T) {
+	fired := 0
+	flow := Barrier(a, b).THEN(c).DO(func(data EventData) {
+		fired++
+	}).Build()
+
+	state := flow.Advance(B).Advance(C).Advance(A)
+	if state.Finished() {
+		t.Errorf("flow continued past the barrier before every path arrived")
+	}
+	if !state.Advance(C).Finished() || fired != 1 {
+		t.Errorf("flow did not continue past the barrier")
+	}
+	if !finishes(d.THEN(Barrier(a, b)), []string{D, B, A}) {
+		t.Errorf("barrier did not proceed after a THEN")
+	}
+}
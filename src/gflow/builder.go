@@ -0,0 +1,139 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+   FlowBuilder constructs a flow imperatively, one State and transition at a
+   time.  Unlike the operators, which copy their operands so that the States
+   they return can be shared, a FlowBuilder mutates the States it holds in
+   place, which makes it the cheaper choice for flows that are generated
+   programmatically from many small pieces.
+
+   States are referred to by the handles returned from AddState, with the
+   root of the flow always being handle 0.  Once the flow is complete, Build
+   hands its States over to the returned flow and leaves the FlowBuilder
+   empty, so handles obtained before calling Build must not be used
+   afterwards.
+*/
+type FlowBuilder struct {
+	states []*State
+}
+
+// NewFlowBuilder returns a FlowBuilder holding only the root of a new flow.
+func NewFlowBuilder() *FlowBuilder {
+	return &FlowBuilder{states: []*State{new(State)}}
+}
+
+// Root returns the handle of the root of the flow being built.
+func (builder *FlowBuilder) Root() int {
+	return 0
+}
+
+// AddState adds a new State to the flow and returns its handle.
+func (builder *FlowBuilder) AddState() int {
+	builder.states = append(builder.states, new(State))
+	return len(builder.states) - 1
+}
+
+// AddTransition adds a transition from the State with handle from to the
+// State with handle to, which is taken for events that pass the given Test.
+func (builder *FlowBuilder) AddTransition(from int, to int, test Test) {
+	trans := &transition{test: test}
+	builder.states[from].addOut(trans)
+	builder.states[to].addIn(trans)
+}
+
+// DO registers the given action to fire when the State with the given
+// handle is reached, the same as State.DO.
+func (builder *FlowBuilder) DO(state int, action Action) {
+	builder.states[state].DO(action)
+}
+
+// Outcome labels the State with the given handle with the named outcome,
+// the same as State.Outcome.
+func (builder *FlowBuilder) Outcome(state int, name string) {
+	builder.states[state].Outcome(name)
+}
+
+// Build returns the built root of the flow.  It returns an error if any
+// State other than the root has no inbound transitions, or if the
+// transitions form a cycle, neither of which Build supports.
+func (builder *FlowBuilder) Build() (*State, error) {
+	states := builder.states
+	for id, state := range states[1:] {
+		if len(state.in) == 0 {
+			return nil, fmt.Errorf("state %d is not reachable from the root", id+1)
+		}
+	}
+	if len(states[0].in) > 0 {
+		return nil, fmt.Errorf("the root has inbound transitions")
+	}
+	if err := states[0].detectCycle(); err != nil {
+		return nil, err
+	}
+	builder.states = []*State{new(State)}
+	return states[0].Build(), nil
+}
+
+// detectCycle checks that no path through the flow starting at the given
+// root leads back to a State along it, returning an error naming the Tests
+// of the cycle if one does.
+func (root *State) detectCycle() error {
+	// Depth-first search for back edges, using an explicit stack so that
+	// long flows don't exhaust the goroutine stack
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[*State]int)
+	type frame struct {
+		state *State
+		next  int
+	}
+	stack := []frame{{root, 0}}
+	marks[root] = visiting
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next == len(top.state.out) {
+			marks[top.state] = visited
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		trans := top.state.out[top.next]
+		top.next++
+		switch marks[trans.to] {
+		case visiting:
+			// The cycle runs from trans.to down the stack and back
+			var tests []string
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].state == trans.to {
+					for _, f := range stack[i:] {
+						tests = append(tests, cycleTestName(f.state.out[f.next-1]))
+					}
+					break
+				}
+			}
+			return fmt.Errorf("the transitions form a cycle (%s)", strings.Join(tests, " -> "))
+		case unvisited:
+			marks[trans.to] = visiting
+			stack = append(stack, frame{trans.to, 0})
+		}
+	}
+	return nil
+}
+
+// cycleTestName names the Test of the given transition for the errors
+// returned by detectCycle.
+func cycleTestName(trans *transition) string {
+	if trans.epsilon {
+		return "(epsilon)"
+	}
+	return TestName(trans.test)
+}
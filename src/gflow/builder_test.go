@@ -0,0 +1,56 @@
+package gflow
+
+import (
+	"testing"
+)
+
+func TestFlowBuilder(t *testing.T) {
+	var builtFired, composedFired int
+	builder := NewFlowBuilder()
+	afterA, afterBOrC, end := builder.AddState(), builder.AddState(), builder.AddState()
+	builder.AddTransition(builder.Root(), afterA, a)
+	builder.AddTransition(afterA, afterBOrC, b)
+	builder.AddTransition(afterA, afterBOrC, c)
+	builder.AddTransition(afterBOrC, end, d)
+	builder.DO(end, func(data EventData) {
+		builtFired++
+	})
+	built, err := builder.Build()
+	if err != nil {
+		t.Fatalf("unable to build flow: %s", err)
+	}
+	composed := a.THEN(b.OR(c)).THEN(d).DO(func(data EventData) {
+		composedFired++
+	}).Build()
+
+	sequences := append(permutations([]string{A, B, C, D}), permutations([]string{A, B, D})...)
+	sequences = append(sequences, permutations([]string{A, C, D})...)
+	for _, sequence := range sequences {
+		if finishes(built, sequence) != finishes(composed, sequence) {
+			t.Errorf("built and composed flows disagree on sequence %s", sequence)
+		}
+	}
+	if toText(t, built) != toText(t, composed) {
+		t.Errorf("expected %q, got %q", toText(t, composed), toText(t, built))
+	}
+	if builtFired != composedFired || builtFired == 0 {
+		t.Errorf("expected actions to fire equally often, built fired %d times and composed %d", builtFired, composedFired)
+	}
+}
+
+func TestFlowBuilderErrors(t *testing.T) {
+	unreachable := NewFlowBuilder()
+	unreachable.AddState()
+	if _, err := unreachable.Build(); err == nil {
+		t.Errorf("expected unreachable state to be reported")
+	}
+
+	cyclic := NewFlowBuilder()
+	first, second := cyclic.AddState(), cyclic.AddState()
+	cyclic.AddTransition(cyclic.Root(), first, a)
+	cyclic.AddTransition(first, second, b)
+	cyclic.AddTransition(second, first, c)
+	if _, err := cyclic.Build(); err == nil {
+		t.Errorf("expected cycle to be reported")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"context"
+)
+
+// ContextTest is a Test that respects the deadline and cancellation of a
+// context.Context and can fail with an error.  See TestWithContext.
+type ContextTest func(ctx context.Context, data EventData) (bool, error)
+
+// ContextAction is an Action that respects the deadline and cancellation of
+// a context.Context and can fail with an error.  See DOContext.
+type ContextAction func(ctx context.Context, data EventData) error
+
+// TestWithContext returns a Test for use in flows that AdvanceContext hands
+// its context.Context.  Advance and the other ways of advancing a flow hand
+// it context.Background(), treating any error as the event failing the Test.
+func TestWithContext(test ContextTest) Test {
+	return Describe(NewTest(func(data EventData) bool {
+		passed, err := test(context.Background(), data)
+		return passed && err == nil
+	}), contextual{test})
+}
+
+type contextual struct {
+	test ContextTest
+}
+
+// DOContext registers the given action to fire when the state is reached,
+// the same as DO.  AdvanceContext hands it its context.Context and returns
+// any error it fails with, whereas Advance and the other ways of advancing a
+// flow hand it context.Background() and ignore its errors.
+func (state *State) DOContext(action ContextAction) *State {
+	state.DO(func(data EventData) {
+		action(context.Background(), data)
+	})
+	for _, s := range state.withEnds() {
+		s.contextActions[len(s.actions)-1] = action
+	}
+	return state
+}
+
+/*
+   AdvanceContext advances the same as Advance, handing the given context to
+   the Tests created with TestWithContext and the actions registered with
+   DOContext.  Other Tests and Actions are called as usual.
+
+   If ctx is done before the event triggers a transition, or a Test fails
+   with an error, AdvanceContext returns the given State along with the
+   error, without taking any transition.  Once the event has triggered a
+   transition, the actions of the State it leads to fire in order until one
+   fails, in which case AdvanceContext returns the new State along with the
+   error, and the remaining actions don't fire.
+*/
+func (state *State) AdvanceContext(ctx context.Context, data EventData) (*State, error) {
+	if err := ctx.Err(); err != nil {
+		return state, err
+	}
+	if state.validate(data) != nil {
+		return state, nil
+	}
+	event := &contextEvent{ctx: ctx, data: data}
+	tran := state.step(event, nil)
+	if event.err != nil {
+		return state, event.err
+	}
+	if tran == nil {
+		return state, nil
+	}
+	tran.to.countEntry()
+	for _, hook := range tran.onEnter {
+		hook(data)
+	}
+	for _, s := range tran.to.closure() {
+		for i, action := range s.actions {
+			if s.conditions[i] != nil && !s.conditions[i](nil) {
+				continue
+			}
+			if contextAction := s.contextActions[i]; contextAction != nil {
+				if err := contextAction(ctx, data); err != nil {
+					return tran.to, err
+				}
+				continue
+			}
+			s.bindState(i, action, tran.to)(data)
+		}
+	}
+	return tran.to, nil
+}
+
+// contextEvent carries an event through step on behalf of AdvanceContext,
+// along with its context.Context and the first error encountered while
+// testing it.
+type contextEvent struct {
+	ctx  context.Context
+	data EventData
+	err  error
+}
+
+// passes checks whether the given EventData passes the Test of the given
+// transition.  Events sent by AdvanceContext are unwrapped, with their
+// context handed to Tests created with TestWithContext.  Once the context
+// is done or a Test fails with an error, no further Tests are passed.
+func (tran *transition) passes(data EventData) bool {
+	event, ok := data.(*contextEvent)
+	if !ok {
+		return tran.test.Pass(data)
+	}
+	if event.err != nil {
+		return false
+	}
+	if event.err = event.ctx.Err(); event.err != nil {
+		return false
+	}
+	desc, ok := describe(tran.test).(contextual)
+	if !ok {
+		return tran.test.Pass(event.data)
+	}
+	passed, err := desc.test(event.ctx, event.data)
+	event.err = err
+	return passed && err == nil
+}
@@ -0,0 +1,67 @@
+package gflow
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAdvanceContext(t *testing.T) {
+	type ctxKey struct{}
+	var seen []interface{}
+	isA := TestWithContext(func(ctx context.Context, data EventData) (bool, error) {
+		seen = append(seen, ctx.Value(ctxKey{}))
+		return data == A, nil
+	})
+	var fired []string
+	flow := isA.THEN(b).state().DOContext(func(ctx context.Context, data EventData) error {
+		fired = append(fired, "context")
+		return nil
+	}).DO(func(data EventData) {
+		fired = append(fired, "plain")
+	}).Build()
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	state, err := flow.AdvanceContext(ctx, A)
+	if err != nil || state != flow.Advance(A) || len(seen) != 2 || seen[0] != "request" || seen[1] != nil {
+		t.Errorf("expected test to see the context, got %v and %v", seen, err)
+	}
+	state, err = state.AdvanceContext(ctx, B)
+	if err != nil || !state.Finished() || len(fired) != 2 || fired[0] != "context" || fired[1] != "plain" {
+		t.Errorf("expected context and plain actions to fire in order, got %v and %v", fired, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if state, err := flow.AdvanceContext(cancelled, A); state != flow || err != context.Canceled {
+		t.Errorf("expected cancelled context to leave the flow unchanged, got %v", err)
+	}
+}
+
+func TestAdvanceContextErrors(t *testing.T) {
+	failure := errors.New("unavailable")
+	failing := TestWithContext(func(ctx context.Context, data EventData) (bool, error) {
+		return true, failure
+	})
+	flow := failing.OR(a).Build()
+	if state, err := flow.AdvanceContext(context.Background(), A); state != flow || err != failure {
+		t.Errorf("expected test error to leave the flow unchanged, got %v", err)
+	}
+	if !flow.Advance(A).Finished() {
+		t.Errorf("expected Advance to treat test error as failing the test")
+	}
+
+	var fired int
+	actions := a.state().DOContext(func(ctx context.Context, data EventData) error {
+		return failure
+	}).DO(func(data EventData) {
+		fired++
+	}).Build()
+	if state, err := actions.AdvanceContext(context.Background(), A); !state.Finished() || err != failure || fired != 0 {
+		t.Errorf("expected action error to stop later actions, got %v", err)
+	}
+	actions.Advance(A)
+	if fired != 1 {
+		t.Errorf("expected Advance to ignore action errors")
+	}
+}
@@ -0,0 +1,460 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Descriptor describes a Test to the parts of this package that analyze
+// flows.  Descriptors are carried by the Tests they describe, which are
+// created using Describe.  A Descriptor may implement any of the
+// following interfaces to tell the package more about its Test:
+//
+//	Overlapper   whether the Test passes some of the same events as another
+//	Satisfiable  whether the Test can pass any event at all
+//	Keyer        a key shared by all Tests that do the same thing
+//	Coster       how expensive the Test is to evaluate
+//	Prioritizer  which Test wins when several pass the same event
+//	Pure         whether the Test is free of side effects
+type Descriptor interface{}
+
+// Overlapper is implemented by Descriptors that know whether their Test
+// passes some of the same events as the Test described by another
+// Descriptor.
+type Overlapper interface {
+	Overlaps(other Descriptor) bool
+}
+
+// Satisfiable is implemented by Descriptors that know whether their Test can
+// pass any event at all.
+type Satisfiable interface {
+	CanPass() bool
+}
+
+// Keyer is implemented by Descriptors that identify what their Test does
+// with a key, such as "Equals(string(\"A\"))".  Tests are otherwise compared by
+// identity, so two separately constructed Tests that do the same thing are
+// considered different.  Tests with the same non-empty key are considered
+// the same Test, for example when merging the branches of an OR.
+type Keyer interface {
+	Key() string
+}
+
+// Coster is implemented by Descriptors that know how expensive their Test
+// is to evaluate relative to other Tests.  Build orders the outbound
+// transitions of each State so that cheaper Tests are evaluated first,
+// sparing expensive Tests whenever a cheaper one passes.  Tests without a
+// Coster have a cost of 0.
+type Coster interface {
+	Cost() int
+}
+
+// Prioritizer is implemented by Descriptors that rank their Test among the
+// Tests of the other outbound transitions of a State.  When several of them
+// pass the same event, Advance takes the transition whose Test has the
+// highest priority.  Build orders the transitions accordingly, before
+// ordering transitions of the same priority by cost (see Coster), and keeps
+// the order in which transitions were added where both are the same.  Tests
+// without a Prioritizer have a priority of 0.  See PriorityTest.
+type Prioritizer interface {
+	Priority() int
+}
+
+// Pure is implemented by Descriptors whose Test is free of side effects,
+// meaning that evaluating it any number of times has no effect beyond
+// returning its result.  Advancing a flow is only free of side effects (aside
+// from its Actions) if all of its Tests are, which gflow expects but can't
+// check, so BuildStrict instead requires every Test to be declared pure.
+type Pure interface {
+	Pure() bool
+}
+
+// DeclarePure returns a Test that passes the same events as the given Test
+// and is declared to be pure (see Pure), in place of any Descriptor of the
+// given Test.
+func DeclarePure(test Test) Test {
+	return Describe(test, declaredPure{})
+}
+
+type declaredPure struct{}
+
+func (desc declaredPure) Pure() bool {
+	return true
+}
+
+// Describe returns a Test that passes the same events as the given Test and
+// is described by the given Descriptor, in place of any Descriptor of the
+// given Test.  Like every Test, the described Test is distinct from the
+// given Test, so it should be created once and then used wherever it's
+// needed.
+func Describe(test Test, desc Descriptor) Test {
+	return Test{&testDef{pass: test.def.pass, desc: desc}}
+}
+
+// describe returns the Descriptor of the given Test, or nil if it doesn't
+// have one.
+func describe(test Test) Descriptor {
+	if test.def == nil {
+		return nil
+	}
+	return test.def.desc
+}
+
+// key returns the key of the given Test, or "" if it doesn't have one.
+func key(test Test) string {
+	if keyer, ok := describe(test).(Keyer); ok {
+		return keyer.Key()
+	}
+	return ""
+}
+
+// cost returns the cost of the given Test, or 0 if it doesn't have one.
+func cost(test Test) int {
+	if coster, ok := describe(test).(Coster); ok {
+		return coster.Cost()
+	}
+	return 0
+}
+
+// priority returns the priority of the given Test, or 0 if it doesn't have
+// one.
+func priority(test Test) int {
+	if prioritizer, ok := describe(test).(Prioritizer); ok {
+		return prioritizer.Priority()
+	}
+	return 0
+}
+
+// pure checks whether the given Test is declared to be pure (see Pure).
+func pure(test Test) bool {
+	p, ok := describe(test).(Pure)
+	return ok && p.Pure()
+}
+
+// sortByCost orders the outbound transitions of every State in the flow
+// starting at the given root by the priority of their Tests, highest first,
+// and then by cost, keeping the order of transitions with the same priority
+// and cost (see Prioritizer).
+func (root *State) sortByCost() {
+	root.each(func(s *State) {
+		priorities := make([]int, len(s.out))
+		costs := make([]int, len(s.out))
+		for i, trans := range s.out {
+			if !trans.test.isZero() {
+				priorities[i], costs[i] = priority(trans.test), cost(trans.test)
+			}
+		}
+		before := func(i, j int) bool {
+			if priorities[i] != priorities[j] {
+				return priorities[i] > priorities[j]
+			}
+			return costs[i] < costs[j]
+		}
+		// Insertion sort, which is stable and quick for the few
+		// transitions that a State usually has
+		for i := 1; i < len(s.out); i++ {
+			for j := i; j > 0 && before(j, j-1); j-- {
+				s.out[j], s.out[j-1] = s.out[j-1], s.out[j]
+				priorities[j], priorities[j-1] = priorities[j-1], priorities[j]
+				costs[j], costs[j-1] = costs[j-1], costs[j]
+			}
+		}
+		for _, branch := range s.lazy {
+			branch.sortByCost()
+		}
+	})
+}
+
+// sameTest checks whether the given Tests are the same Test, either by
+// identity or by having the same key (see Keyer).
+func sameTest(test Test, other Test) bool {
+	if test == other {
+		return true
+	}
+	testKey := key(test)
+	return testKey != "" && testKey == key(other)
+}
+
+// overlaps checks whether the given Tests are the same Test or are declared
+// by their Descriptors to pass some of the same events.
+func overlaps(test Test, other Test) bool {
+	if sameTest(test, other) {
+		return true
+	}
+	desc, otherDesc := describe(test), describe(other)
+	if overlapper, ok := desc.(Overlapper); ok && overlapper.Overlaps(otherDesc) {
+		return true
+	}
+	if overlapper, ok := otherDesc.(Overlapper); ok && overlapper.Overlaps(desc) {
+		return true
+	}
+	return false
+}
+
+// canPass checks whether the given Test might pass some event, which it
+// assumes unless the Test's Descriptor says otherwise (see Satisfiable).
+func canPass(test Test) bool {
+	if satisfiable, ok := describe(test).(Satisfiable); ok {
+		return satisfiable.CanPass()
+	}
+	return true
+}
+
+// contradicts checks whether the given Tests are known never to pass the
+// same event, like a Test and its negation or Equals Tests for different
+// values.
+func contradicts(test Test, other Test) bool {
+	desc, otherDesc := describe(test), describe(other)
+	if negation, ok := desc.(not); ok && equivalent(negation.test, other) {
+		return true
+	}
+	if negation, ok := otherDesc.(not); ok && equivalent(negation.test, test) {
+		return true
+	}
+	equalsDesc, ok := desc.(equals)
+	otherEqualsDesc, otherOk := otherDesc.(equals)
+	return ok && otherOk && !reflect.DeepEqual(equalsDesc.value, otherEqualsDesc.value)
+}
+
+// equivalent checks whether the given Tests are the same Test or have equal
+// Descriptors.
+func equivalent(test Test, other Test) bool {
+	if sameTest(test, other) {
+		return true
+	}
+	desc := describe(test)
+	return desc != nil && reflect.DeepEqual(desc, describe(other))
+}
+
+// Equals returns a Test that passes events equal to the given value.
+func Equals(value EventData) Test {
+	return Describe(NewTest(func(data EventData) bool {
+		return reflect.DeepEqual(data, value)
+	}), equals{value})
+}
+
+type equals struct {
+	value EventData
+}
+
+func (desc equals) Pure() bool {
+	return true
+}
+
+func (desc equals) Key() string {
+	// The type keeps values that print the same, such as 1 and int64(1),
+	// from sharing a key
+	return fmt.Sprintf("Equals(%T(%#v))", desc.value, desc.value)
+}
+
+func (desc equals) Overlaps(other Descriptor) bool {
+	otherEquals, ok := other.(equals)
+	return ok && reflect.DeepEqual(desc.value, otherEquals.value)
+}
+
+// NamedTest returns a Test that passes the same events as the given Test and
+// is labeled with the given name in diagnostics, such as ToDot, Canonical
+// and the logs kept by Runner.Record.  The named Test is described the same
+// as the given Test, except that it is named, so naming a Test doesn't
+// change how flows using it are merged or checked.  Since operators copy
+// transitions along with their Tests, the name survives THEN, OR and AND.
+func NamedTest(name string, test Test) Test {
+	return Describe(test, named{wrapper{test}, name})
+}
+
+// TestName returns the name of the given Test (see NamedTest), or else its
+// key (see Keyer), or else a name generated from its identity.
+func TestName(test Test) string {
+	if testName := label(test); testName != "" {
+		return testName
+	}
+	return fmt.Sprintf("test@%p", test.def)
+}
+
+// label returns the name or else the key of the given Test, or "" if it has
+// neither.
+func label(test Test) string {
+	switch desc := describe(test).(type) {
+	case named:
+		return desc.name
+	case prioritized:
+		return label(desc.test)
+	}
+	return key(test)
+}
+
+// PriorityTest returns a Test that passes the same events as the given Test
+// and has the given priority (see Prioritizer).  The prioritized Test is
+// described the same as the given Test otherwise.
+func PriorityTest(priority int, test Test) Test {
+	return Describe(test, prioritized{wrapper{test}, priority})
+}
+
+// wrapper describes a Test that wraps another Test, describing it the same
+// as the wrapped Test.
+type wrapper struct {
+	test Test
+}
+
+func (desc wrapper) Key() string {
+	return key(desc.test)
+}
+
+func (desc wrapper) Pure() bool {
+	return pure(desc.test)
+}
+
+func (desc wrapper) Cost() int {
+	return cost(desc.test)
+}
+
+func (desc wrapper) Priority() int {
+	return priority(desc.test)
+}
+
+func (desc wrapper) CanPass() bool {
+	return canPass(desc.test)
+}
+
+func (desc wrapper) Overlaps(other Descriptor) bool {
+	overlapper, ok := describe(desc.test).(Overlapper)
+	return ok && overlapper.Overlaps(other)
+}
+
+type named struct {
+	wrapper
+	name string
+}
+
+type prioritized struct {
+	wrapper
+	priority int
+}
+
+func (desc prioritized) Priority() int {
+	return desc.priority
+}
+
+// Always is a Test that passes every event, for transitions that should be
+// taken on whatever event arrives next.
+var Always Test = Describe(NewTest(func(data EventData) bool {
+	return true
+}), always{})
+
+// Never is a Test that fails every event, for disabling a branch of a flow
+// without changing its structure.
+var Never Test = Describe(NewTest(func(data EventData) bool {
+	return false
+}), never{})
+
+type always struct{}
+
+func (desc always) Pure() bool {
+	return true
+}
+
+func (desc always) Key() string {
+	return "Always"
+}
+
+func (desc always) Overlaps(other Descriptor) bool {
+	satisfiable, ok := other.(Satisfiable)
+	return !ok || satisfiable.CanPass()
+}
+
+type never struct{}
+
+func (desc never) Pure() bool {
+	return true
+}
+
+func (desc never) Key() string {
+	return "Never"
+}
+
+func (desc never) CanPass() bool {
+	return false
+}
+
+// Not returns a Test that passes the events that the given Test fails.
+// Since a negated Test usually passes most events, it costs one more than
+// the given Test, so that Build orders it after sibling Tests of the same
+// cost (see Coster).
+func Not(test Test) Test {
+	return Describe(NewTest(func(data EventData) bool {
+		return !test.Pass(data)
+	}), not{test})
+}
+
+type not struct {
+	test Test
+}
+
+func (desc not) Pure() bool {
+	return pure(desc.test)
+}
+
+func (desc not) Cost() int {
+	return cost(desc.test) + 1
+}
+
+func (desc not) Key() string {
+	if testKey := key(desc.test); testKey != "" {
+		return "Not(" + testKey + ")"
+	}
+	return ""
+}
+
+// All returns a Test that passes the events that pass every one of the given
+// Tests.
+func All(tests ...Test) Test {
+	return Describe(NewTest(func(data EventData) bool {
+		for _, test := range tests {
+			if !test.Pass(data) {
+				return false
+			}
+		}
+		return true
+	}), all{tests})
+}
+
+type all struct {
+	tests []Test
+}
+
+func (desc all) Key() string {
+	keys := make([]string, len(desc.tests))
+	for i, test := range desc.tests {
+		if keys[i] = key(test); keys[i] == "" {
+			return ""
+		}
+	}
+	return "All(" + strings.Join(keys, ", ") + ")"
+}
+
+func (desc all) Pure() bool {
+	for _, test := range desc.tests {
+		if !pure(test) {
+			return false
+		}
+	}
+	return true
+}
+
+func (desc all) CanPass() bool {
+	for i, test := range desc.tests {
+		if !canPass(test) {
+			return false
+		}
+		for _, other := range desc.tests[i+1:] {
+			if contradicts(test, other) {
+				return false
+			}
+		}
+	}
+	return true
+}
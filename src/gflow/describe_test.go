@@ -0,0 +1,202 @@
+package gflow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEquals(t *testing.T) {
+	flow := Equals("x").THEN(Equals(1)).Build()
+	if !flow.Advance("y").Advance("x").Advance("1").Advance(1).Finished() {
+		t.Errorf("Equals tests did not advance the flow")
+	}
+}
+
+func TestBuildStrict(t *testing.T) {
+	ambiguous, err := FromText("1 -x-> 2; 1 -alsoX-> 3", map[string]Test{"x": Equals("x"), "alsoX": Equals("x")})
+	if err != nil {
+		t.Fatalf("unable to parse flow: %s", err)
+	}
+	if _, err := ambiguous.BuildStrict(); err == nil {
+		t.Errorf("expected two Equals(string(\"x\")) transitions to be reported as non-deterministic")
+	}
+	if _, err := Equals("x").OR(Equals("y").THEN(Not(Equals("z")))).BuildStrict(); err != nil {
+		t.Errorf("unexpected error for deterministic flow: %s", err)
+	}
+}
+
+func TestBuildStrictPure(t *testing.T) {
+	if _, err := a.OR(b).BuildStrict(); err == nil {
+		t.Errorf("expected undeclared tests to be rejected")
+	}
+	if _, err := Equals("x").THEN(All(Equals("y"), a)).BuildStrict(); err == nil {
+		t.Errorf("expected combination of undeclared test to be rejected")
+	}
+	isLong := DeclarePure(NewTest(func(data EventData) bool {
+		return len(data.(string)) > 3
+	}))
+	if _, err := Equals("x").THEN(isLong).BuildStrict(); err != nil {
+		t.Errorf("unexpected error for tests declared pure: %s", err)
+	}
+}
+
+func TestNotAndAll(t *testing.T) {
+	flow := All(Not(Equals("x")), Not(Equals("y"))).state().Build()
+	if flow.Advance("x").Finished() || flow.Advance("y").Finished() {
+		t.Errorf("combined test passed an event that one of its tests fails")
+	}
+	if !flow.Advance("z").Finished() {
+		t.Errorf("combined test failed an event that all of its tests pass")
+	}
+}
+
+func TestKeyedTestsMergeInOR(t *testing.T) {
+	flow := Equals(A).THEN(c).OR(Equals(A).THEN(d)).Build()
+	if len(flow.out) != 1 {
+		t.Errorf("expected separately constructed Equals tests to merge, got %d transitions", len(flow.out))
+	}
+	if !finishes(flow, []string{A, D}) || !finishes(flow, []string{A, C}) {
+		t.Errorf("expected both branches to continue after merged test")
+	}
+	if typed := Equals(1).THEN(c).OR(Equals(int64(1)).THEN(d)).Build(); len(typed.out) != 2 || key(Equals(1)) == key(Equals(int64(1))) {
+		t.Errorf("expected Equals tests for values of different types not to merge")
+	}
+
+	if key(Not(Equals(A))) != key(Not(Equals(A))) || key(Not(a)) != "" {
+		t.Errorf("unexpected keys for negated tests")
+	}
+	if len(All(Equals(A), Equals(B)).OR(All(Equals(A), Equals(B))).Alphabet()) != 1 {
+		t.Errorf("expected keyed tests to be counted once in alphabet")
+	}
+}
+
+type costly int
+
+func (c costly) Cost() int {
+	return int(c)
+}
+
+func countingTest(value string, cost int, count *int) Test {
+	return Describe(NewTest(func(data EventData) bool {
+		*count++
+		return data == value
+	}), costly(cost))
+}
+
+func TestCost(t *testing.T) {
+	var expensiveCalls, cheapCalls int
+	expensive := countingTest("x", 10, &expensiveCalls)
+	cheap := countingTest("y", 1, &cheapCalls)
+	flow := expensive.THEN(a).OR(cheap.THEN(b)).Build()
+
+	if state := flow.Advance("y"); expensiveCalls != 0 || state == flow {
+		t.Errorf("expected cheap test to pass without evaluating expensive test, evaluated it %d times", expensiveCalls)
+	}
+	if !flow.Advance("x").Advance(A).Finished() || !flow.Advance("y").Advance(B).Finished() {
+		t.Errorf("expected ordering by cost to preserve results")
+	}
+	if flow.Advance("x").Advance(B).Finished() || flow.Advance("y").Advance(A).Finished() {
+		t.Errorf("expected ordering by cost to preserve results")
+	}
+}
+
+func BenchmarkCost(b *testing.B) {
+	var expensiveCalls, cheapCalls int
+	expensive := countingTest("x", 10, &expensiveCalls)
+	cheap := countingTest("y", 1, &cheapCalls)
+	flow := expensive.OR(cheap).Build()
+
+	for i := 0; i < b.N; i++ {
+		flow.Advance("y")
+	}
+	if expensiveCalls > 0 {
+		b.Errorf("expensive test was evaluated %d times", expensiveCalls)
+	}
+}
+
+func TestAlwaysAndNever(t *testing.T) {
+	flow := a.THEN(Always).THEN(b).Build()
+	if !finishes(flow, []string{A, C, B}) || !finishes(flow, []string{A, B, B}) || finishes(flow, []string{A, B}) {
+		t.Errorf("expected Always to consume whatever event arrives next")
+	}
+
+	disabled := Never.THEN(c).OR(a).Build()
+	if !finishes(disabled, []string{A}) || finishes(disabled, []string{C}) {
+		t.Errorf("expected Never to disable its branch")
+	}
+	if dead := disabled.DeadTransitions(); len(dead) != 1 || dead[0].Test != Never {
+		t.Errorf("expected Never transition to be reported as dead, got %v", dead)
+	}
+
+	if len(Always.OR(Always).Build().out) != 1 || len(Never.OR(Never).Build().out) != 1 {
+		t.Errorf("expected Always and Never to merge by key")
+	}
+	if _, err := Always.OR(Equals("x")).BuildStrict(); err == nil {
+		t.Errorf("expected Always to overlap other tests")
+	}
+	if _, err := Never.OR(Equals("x")).BuildStrict(); err != nil {
+		t.Errorf("unexpected error for Never alongside another test: %s", err)
+	}
+}
+
+func TestNamedTest(t *testing.T) {
+	isA := NamedTest("isA", a)
+	flow := isA.THEN(b).OR(c.AND(isA)).Build()
+	if !finishes(flow, []string{A, B}) || !finishes(flow, []string{A, C}) {
+		t.Errorf("expected named test to pass the same events as the test it names")
+	}
+	if dot := ToDot(flow, nil); !strings.Contains(dot, `[label="isA"]`) || strings.Contains(dot, `[label="t3"]`) {
+		t.Errorf("expected named test to keep its name once copied by operators, got\n%s", dot)
+	}
+
+	runner := flow.Run().Record("s", nil)
+	runner.Advance(A)
+	if log := runner.Log(); len(log) != 1 || log[0].Test != "isA" {
+		t.Errorf("expected transition to be logged by name, got %v", log)
+	}
+
+	if TestName(isA) != "isA" || TestName(Equals(A)) != `Equals(string("A"))` || !strings.HasPrefix(TestName(a), "test@") {
+		t.Errorf("unexpected names %q, %q and %q", TestName(isA), TestName(Equals(A)), TestName(a))
+	}
+	if len(NamedTest("first", Equals(A)).OR(NamedTest("second", Equals(A))).Build().out) != 1 {
+		t.Errorf("expected naming to leave keyed tests merging")
+	}
+}
+
+// branches builds a flow that starts with either of the given Tests,
+// followed by B or C respectively.
+func branches(first Test, second Test) *State {
+	builder := NewFlowBuilder()
+	afterFirst, afterSecond, end := builder.AddState(), builder.AddState(), builder.AddState()
+	builder.AddTransition(builder.Root(), afterFirst, first)
+	builder.AddTransition(builder.Root(), afterSecond, second)
+	builder.AddTransition(afterFirst, end, b)
+	builder.AddTransition(afterSecond, end, c)
+	flow, _ := builder.Build()
+	return flow
+}
+
+func TestPriorityTest(t *testing.T) {
+	flow := branches(Always, PriorityTest(1, a))
+	if !finishes(flow, []string{A, C}) || finishes(flow, []string{A, B}) {
+		t.Errorf("expected higher priority test to win over earlier transition")
+	}
+	if !finishes(flow, []string{D, B}) {
+		t.Errorf("expected lower priority test to pass events the other fails")
+	}
+	if !finishes(branches(Always, a), []string{A, B}) {
+		t.Errorf("expected ties to fall back to the order in which transitions were added")
+	}
+
+	isA := Describe(NewTest(func(data EventData) bool {
+		return data == A
+	}), costly(1))
+	if !finishes(branches(PriorityTest(1, isA), PriorityTest(1, a)), []string{A, C}) {
+		t.Errorf("expected ties in priority to fall back to cost")
+	}
+
+	named := NamedTest("important", PriorityTest(2, a))
+	if priority(named) != 2 || TestName(PriorityTest(1, named)) != "important" {
+		t.Errorf("expected naming and priorities to combine")
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// encodedFlow is the JSON form of a flow written by EncodeFlow.
+type encodedFlow struct {
+	States      []encodedState
+	Transitions []encodedTransition
+}
+
+type encodedState struct {
+	ID       int
+	Kind     StateKind `json:",omitempty"`
+	Outcome  string    `json:",omitempty"`
+	AndGroup int       `json:",omitempty"`
+	Together bool      `json:",omitempty"`
+	Until    string    `json:",omitempty"`
+}
+
+type encodedTransition struct {
+	From     int
+	To       int
+	Test     string        `json:",omitempty"`
+	Timeout  time.Duration `json:",omitempty"`
+	Perm     string        `json:",omitempty"`
+	Epsilon  bool          `json:",omitempty"`
+	AndWidth int           `json:",omitempty"`
+}
+
+/*
+   EncodeFlow encodes the structure of the built flow containing the given
+   State as JSON, so that it can be stored and later rebuilt with DecodeFlow.
+   The encoding lists the States of the flow by ID, along with their kinds,
+   outcomes, the ANDs they belong to and the Tests they wait on (see
+   UNTIL), and its transitions by the IDs of the States they connect, the
+   name that namer gives their Test (or TestName if namer is nil), their
+   permission and whether they are epsilon transitions.  Timeouts are
+   encoded by their duration rather than by name.
+
+   Tests and Actions wrap functions and can't be encoded, so they must be
+   supplied again when decoding.  Guards (see THENIf) and the transforms of
+   PIPEs also wrap functions, but can't be supplied again, so EncodeFlow
+   returns an error for flows that use them.  Lazily evaluated ANDs are
+   encoded in full, the same as by ToText, but the flows that each AND
+   combined are not, so VerifyAndCompletion doesn't check decoded ANDs.
+*/
+func EncodeFlow(state *State, namer TestNamer) ([]byte, error) {
+	if namer == nil {
+		namer = TestName
+	}
+	root := state.eager().root()
+	if root != state.root() {
+		root.Build()
+	}
+	if err := root.checkUnguarded(); err != nil {
+		return nil, err
+	}
+	var flow encodedFlow
+	var err error
+	root.each(func(s *State) {
+		encState := encodedState{ID: s.ID, Kind: s.kind, Outcome: s.outcome, Together: s.together}
+		if s.andGroup != nil {
+			encState.AndGroup = s.andGroup.ID
+		}
+		if !s.until.isZero() {
+			encState.Until = namer(s.until)
+		}
+		flow.States = append(flow.States, encState)
+		for _, trans := range s.out {
+			if trans.transform != nil && err == nil {
+				err = fmt.Errorf("transition from state %d to state %d has a transform, which can't be encoded", s.ID, trans.to.ID)
+			}
+			encoded := encodedTransition{From: s.ID, To: trans.to.ID, Perm: trans.perm, Epsilon: trans.epsilon, AndWidth: trans.andWidth}
+			if after, ok := timeoutAfter(trans.test); ok {
+				encoded.Timeout = after
+			} else if !trans.epsilon {
+				encoded.Test = namer(trans.test)
+			}
+			flow.Transitions = append(flow.Transitions, encoded)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(flow)
+}
+
+// DecodeFlow rebuilds a flow encoded by EncodeFlow, looking up the Tests for
+// its transitions by name in the given map, and returns its built root.  The
+// States of the decoded flow keep the IDs of the encoded flow, however they
+// were assigned (see BuildStable and BuildWith).  DecodeFlow returns an
+// error if the transitions form a cycle or leave any State unreachable from
+// the root, neither of which Build supports.  The decoded flow has no
+// Actions, which must be registered again.
+func DecodeFlow(data []byte, tests map[string]Test) (*State, error) {
+	var flow encodedFlow
+	if err := json.Unmarshal(data, &flow); err != nil {
+		return nil, err
+	}
+	if len(flow.States) == 0 {
+		return nil, fmt.Errorf("encoded flow has no states")
+	}
+
+	states := make(map[int]*State, len(flow.States))
+	for _, encoded := range flow.States {
+		if states[encoded.ID] != nil {
+			return nil, fmt.Errorf("encoded flow has more than one state %d", encoded.ID)
+		}
+		state := &State{kind: encoded.Kind, outcome: encoded.Outcome, together: encoded.Together}
+		if encoded.Until != "" {
+			test, ok := tests[encoded.Until]
+			if !ok {
+				return nil, fmt.Errorf("unknown test %q waited on by state %d", encoded.Until, encoded.ID)
+			}
+			state.until = test
+		}
+		states[encoded.ID] = state
+	}
+	for _, encoded := range flow.States {
+		if encoded.AndGroup != 0 {
+			end := states[encoded.AndGroup]
+			if end == nil {
+				return nil, fmt.Errorf("state %d belongs to the AND of unknown state %d", encoded.ID, encoded.AndGroup)
+			}
+			states[encoded.ID].andGroup = end
+		}
+	}
+	for _, encoded := range flow.Transitions {
+		from, to := states[encoded.From], states[encoded.To]
+		if from == nil || to == nil {
+			return nil, fmt.Errorf("transition from state %d to state %d connects an unknown state", encoded.From, encoded.To)
+		}
+		trans := &transition{perm: encoded.Perm, epsilon: encoded.Epsilon, andWidth: encoded.AndWidth}
+		if encoded.Timeout > 0 {
+			trans.test = Timeout(encoded.Timeout)
+		} else if !encoded.Epsilon {
+			test, ok := tests[encoded.Test]
+			if !ok {
+				return nil, fmt.Errorf("unknown test %q in transition from state %d to state %d", encoded.Test, encoded.From, encoded.To)
+			}
+			trans.test = test
+		}
+		from.addOut(trans)
+		to.addIn(trans)
+	}
+
+	rootID := flow.States[0].ID
+	root := states[rootID]
+	reachable := make(map[*State]bool)
+	root.each(func(s *State) {
+		reachable[s] = true
+	})
+	for id, state := range states {
+		if !reachable[state] {
+			return nil, fmt.Errorf("state %d is not reachable from state %d", id, rootID)
+		}
+	}
+	if err := root.detectCycle(); err != nil {
+		return nil, err
+	}
+	for id, state := range states {
+		state.ID = id
+	}
+	return root.finishBuild(), nil
+}
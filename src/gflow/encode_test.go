@@ -0,0 +1,130 @@
+package gflow
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeFlow(t *testing.T) {
+	flow := a.THEN(b).OR(c.AND(d)).OR(b.THENAuth(a, "p").Outcome("authorized")).Build()
+	encoded, err := EncodeFlow(flow, nameTest)
+	if err != nil {
+		t.Fatalf("unable to encode flow: %s", err)
+	}
+	decoded, err := DecodeFlow(encoded, testNames)
+	if err != nil {
+		t.Fatalf("unable to decode %s: %s", encoded, err)
+	}
+
+	if toText(t, decoded) != toText(t, flow) {
+		t.Errorf("round trip changed %q into %q", toText(t, flow), toText(t, decoded))
+	}
+	flow.each(func(s *State) {
+		d := decoded.FindByID(s.ID)
+		if d == nil || d.Kind() != s.Kind() || d.outcome != s.outcome {
+			t.Errorf("expected decoded state %d to match", s.ID)
+		}
+	})
+	for _, steps := range [][]string{{A, B}, {D, C}, {C, A, D}} {
+		if !finishes(decoded, steps) {
+			t.Errorf("decoded flow did not complete for %s", steps)
+		}
+	}
+	perms := []string{"p"}
+	original, state := flow.AdvanceAs(B, perms).AdvanceAs(A, perms), decoded.AdvanceAs(B, perms).AdvanceAs(A, perms)
+	if state.ID != original.ID || state.outcome != original.outcome || decoded.Advance(B).Advance(A).ID != flow.Advance(B).Advance(A).ID {
+		t.Errorf("expected decoded flow to keep permissions and outcomes")
+	}
+
+	if _, err := DecodeFlow(encoded, map[string]Test{"a": a}); err == nil {
+		t.Errorf("expected error for missing test")
+	}
+	if _, err := DecodeFlow([]byte(`{"States":[{"ID":1},{"ID":2}]}`), testNames); err == nil {
+		t.Errorf("expected error for unreachable state")
+	}
+	cycles := []string{
+		`{"States":[{"ID":1},{"ID":2},{"ID":3}],"Transitions":[{"From":1,"To":2,"Test":"a"},{"From":2,"To":3,"Test":"b"},{"From":3,"To":2,"Test":"c"}]}`,
+		`{"States":[{"ID":1},{"ID":2}],"Transitions":[{"From":1,"To":2,"Test":"a"},{"From":2,"To":1,"Test":"b"}]}`,
+	}
+	for _, cycle := range cycles {
+		if _, err := DecodeFlow([]byte(cycle), testNames); err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Errorf("expected error for cyclic transitions, got %v", err)
+		}
+	}
+}
+
+func TestEncodeFlowEpsilon(t *testing.T) {
+	flow := a.EPSILON(b).Build()
+	encoded, err := EncodeFlow(flow, nameTest)
+	if err != nil {
+		t.Fatalf("unable to encode flow: %s", err)
+	}
+	decoded, err := DecodeFlow(encoded, testNames)
+	if err != nil {
+		t.Fatalf("unable to decode %s: %s", encoded, err)
+	}
+	if decoded.Canonical() != flow.Canonical() || !finishes(decoded, []string{A, B}) {
+		t.Errorf("expected epsilon transition to survive round trip, got\n%s", decoded.Canonical())
+	}
+}
+
+func TestEncodeFlowGuard(t *testing.T) {
+	veto := func(data EventData) bool {
+		return false
+	}
+	flow := a.THENIf(veto, b).Build()
+	if encoded, err := EncodeFlow(flow, nameTest); err == nil {
+		t.Errorf("expected error for guarded flow, got %s", encoded)
+	}
+	if _, err := EncodeFlow(a.THEN(b).Build(), nameTest); err != nil {
+		t.Errorf("unable to encode unguarded flow: %s", err)
+	}
+}
+
+func TestEncodeFlowFeatures(t *testing.T) {
+	roundTrip := func(flow *State) *State {
+		encoded, err := EncodeFlow(flow, nameTest)
+		if err != nil {
+			t.Fatalf("unable to encode flow: %s", err)
+		}
+		decoded, err := DecodeFlow(encoded, testNames)
+		if err != nil {
+			t.Fatalf("unable to decode %s: %s", encoded, err)
+		}
+		return decoded
+	}
+
+	waiting := roundTrip(c.THEN(a.UNTIL(b)).Build()).Advance(C)
+	if state, advanced := waiting.AdvanceE(A); !advanced || state != waiting || !state.Advance(B).Finished() {
+		t.Errorf("expected decoded UNTIL to absorb A until B")
+	}
+
+	together := roundTrip(a.THEN(b).AND(b).CompleteTogether().Build())
+	if !finishes(together, []string{A, B}) || together.MaxAndWidth() != 2 {
+		t.Errorf("expected decoded AND to complete together")
+	}
+
+	now := epoch
+	timed := roundTrip(a.THEN(b.OR(Timeout(time.Minute).THEN(c))).Build())
+	run := timed.Run().Clock(func() time.Time {
+		return now
+	})
+	run.Advance(A)
+	now = now.Add(2 * time.Minute)
+	if timedOut := run.AdvanceClock(); !timedOut.Advance(C).Finished() {
+		t.Errorf("expected decoded flow to time out")
+	}
+
+	mid := a.LAZYAND(b).THEN(c).Build().Advance(A)
+	if !finishes(roundTrip(mid), []string{B, C}) {
+		t.Errorf("expected position inside lazy AND to encode the rest of the flow")
+	}
+
+	piped := a.PIPE(func(data EventData) EventData {
+		return data
+	}, b).Build()
+	if encoded, err := EncodeFlow(piped, nameTest); err == nil {
+		t.Errorf("expected error for flow with a transform, got %s", encoded)
+	}
+}
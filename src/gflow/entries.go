@@ -0,0 +1,85 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"sync/atomic"
+)
+
+// entryCounts holds the number of times each State of a flow has been
+// entered, keyed by ID.  The map is only read once it has been filled, so
+// runs may look up their counters concurrently.  See CountEntries.
+type entryCounts struct {
+	counts map[int]*uint64
+}
+
+/*
+   CountEntries builds the flow containing the given State, unless it has
+   already been built, and starts counting how often each of its States is entered, across every run on the
+   flow, for example to draw a heatmap of its usage.  The counts are read
+   with EntryCounts.  A flow that has already been built keeps its IDs,
+   however they were assigned (see BuildStable and BuildWith).
+
+   Advance and the other ways of advancing a flow count a State each time a
+   transition leads to it, using atomic operations so that runs on the flow
+   may advance concurrently.  The root is never entered and is always
+   counted as 0, and the positions inside a lazily evaluated AND or a barrier
+   have no ID and aren't counted.  Since operators build new States,
+   CountEntries should be called once the flow is fully composed, and copies
+   of the flow don't count entries.  Calling it again restarts the counts.
+*/
+func (state *State) CountEntries() *State {
+	root := state.root()
+	if root.ID == 0 {
+		root = state.Build()
+	}
+	entries := &entryCounts{counts: make(map[int]*uint64)}
+	root.each(func(s *State) {
+		entries.counts[s.ID] = new(uint64)
+	})
+	root.each(func(s *State) {
+		s.entries = entries
+	})
+	return state
+}
+
+// EntryCounts returns the number of times each State of the flow has been
+// entered since CountEntries was called, keyed by ID, or nil if entries
+// aren't being counted.  Every State of the flow is included, even if it
+// has never been entered.
+func (root *State) EntryCounts() map[int]uint64 {
+	if root.entries == nil {
+		return nil
+	}
+	counts := make(map[int]uint64)
+	root.root().each(func(s *State) {
+		counts[s.ID] = atomic.LoadUint64(root.entries.counts[s.ID])
+	})
+	return counts
+}
+
+// countEntry counts an entry into the given State, if entries are being
+// counted.
+func (state *State) countEntry() {
+	if state.entries == nil {
+		return
+	}
+	if count := state.entries.counts[state.ID]; count != nil {
+		atomic.AddUint64(count, 1)
+	}
+}
+
+// CountingAction returns an Action that counts how many times it fires,
+// along with a function that returns the count so far, for example to tally
+// how many runs finish a flow.  The count is kept using atomic operations,
+// so the Action may fire from runs advancing concurrently.
+func CountingAction() (Action, func() int) {
+	var count int64
+	action := func(data EventData) {
+		atomic.AddInt64(&count, 1)
+	}
+	return action, func() int {
+		return int(atomic.LoadInt64(&count))
+	}
+}
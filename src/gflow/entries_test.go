@@ -0,0 +1,79 @@
+package gflow
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestEntryCounts(t *testing.T) {
+	flow := a.THEN(b).OR(c).Build()
+	afterA := flow.Advance(A)
+	ends := []int{afterA.Advance(B).ID, flow.Advance(C).ID}
+	flow.CountEntries()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%5 == 0 {
+				flow.Advance(C)
+				return
+			}
+			flow.Advance(A).Advance(D).Advance(B)
+		}(i)
+	}
+	wg.Wait()
+
+	counts := flow.EntryCounts()
+	if counts[flow.ID] != 0 || counts[afterA.ID] != 40 {
+		t.Errorf("expected 40 entries after A and none into the root, got %v", counts)
+	}
+	if ends[0] == ends[1] && counts[ends[0]] != 50 {
+		t.Errorf("expected 50 entries into the shared end, got %v", counts)
+	}
+	if len(counts) != 3 {
+		t.Errorf("expected every State to be counted, got %v", counts)
+	}
+}
+
+func TestEntryCountsOptIn(t *testing.T) {
+	flow := a.THEN(b).Build()
+	flow.Advance(A)
+	if counts := flow.EntryCounts(); counts != nil {
+		t.Errorf("expected no counts unless requested, got %v", counts)
+	}
+	flow.CountEntries()
+	flow.Advance(A)
+	flow.AdvanceDeferred(A)
+	if counts := flow.Advance(A).EntryCounts(); counts[2] != 3 {
+		t.Errorf("expected 3 entries into State 2, got %v", counts)
+	}
+}
+
+func TestCountingAction(t *testing.T) {
+	action, count := CountingAction()
+	flow := a.THEN(b).OR(c).DO(action).Build()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%4 == 0 {
+				flow.Advance(C)
+				return
+			}
+			flow.Advance(A).Advance(B)
+		}(i)
+	}
+	wg.Wait()
+
+	if count() != 100 {
+		t.Errorf("expected action to count 100 finished runs, got %d", count())
+	}
+	flow.Advance(A)
+	if count() != 100 {
+		t.Errorf("expected action not to count runs that haven't finished, got %d", count())
+	}
+}
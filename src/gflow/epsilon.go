@@ -0,0 +1,95 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+/*
+   EPSILON constructs a sequential flow like THEN, except that rather than
+   merging the root of to into the end of from, it links them with an
+   epsilon transition, which is taken without consuming an event.  Epsilon
+   transitions are a building block for operators that let part of a flow
+   be skipped or repeated.
+
+   Epsilon transitions make a flow a nondeterministic automaton.  A run at a
+   State is also at every State that can be reached from it by following
+   only epsilon transitions, which together make up the State's epsilon
+   closure.  When advancing, an event triggers the first transition that
+   passes its Test among the outbound transitions of the State itself, then
+   of the other States in its closure, in breadth-first order.  Once the run
+   arrives at a State, the actions of every State in its closure fire, in
+   the same order.  A State is finished only if no State in its closure has
+   an outbound transition that consumes an event (see Finished).
+
+   Advance returns the State that the consumed event led to, not the States
+   in its closure, so the IDs of runs that have passed through epsilon
+   transitions identify the earliest State they could be at.
+*/
+func (from *State) EPSILON(to stateSource) *State {
+	newFrom := from.copy()
+	toState := to.state().copy()
+	link := &transition{epsilon: true}
+	newFrom.addOut(link)
+	toState.root().addIn(link)
+	return toState
+}
+
+func (from Test) EPSILON(to stateSource) *State {
+	return from.state().EPSILON(to)
+}
+
+/*
+   OPTIONAL constructs a flow that may either pass through the flow ending in
+   the given State or skip it entirely, by linking its root to its end with
+   an epsilon transition (see EPSILON).  a.THEN(b.OPTIONAL()).THEN(c)
+   finishes on A, B, C as well as on A, C.
+
+   The bypass consumes no event, so each event still triggers at most one
+   transition.  Once a THEN follows the optional flow, its transitions leave
+   the end that the bypass leads to, which puts them in the epsilon closure
+   of the State before the optional flow.  If the optional flow starts with
+   the same Test as the flow that follows it, an event passing that Test
+   advances into the optional flow, since the transitions of a State take
+   precedence over those of the rest of its closure.
+*/
+func (state *State) OPTIONAL() *State {
+	optional := state.copy()
+	bypass := &transition{epsilon: true}
+	optional.root().addOut(bypass)
+	optional.addIn(bypass)
+	return optional
+}
+
+func (test Test) OPTIONAL() *State {
+	return test.state().OPTIONAL()
+}
+
+// hasEpsilon checks whether the given State has any outbound epsilon
+// transitions.
+func (state *State) hasEpsilon() bool {
+	for _, trans := range state.out {
+		if trans.epsilon {
+			return true
+		}
+	}
+	return false
+}
+
+// closure returns the epsilon closure of the given State, which is the State
+// itself followed by every State reachable from it by following only epsilon
+// transitions, in breadth-first order.
+func (state *State) closure() []*State {
+	closure := []*State{state}
+	if !state.hasEpsilon() {
+		return closure
+	}
+	visited := map[*State]bool{state: true}
+	for i := 0; i < len(closure); i++ {
+		for _, trans := range closure[i].out {
+			if trans.epsilon && !visited[trans.to] {
+				visited[trans.to] = true
+				closure = append(closure, trans.to)
+			}
+		}
+	}
+	return closure
+}
@@ -0,0 +1,87 @@
+package gflow
+
+import (
+	"testing"
+)
+
+func TestEPSILON(t *testing.T) {
+	flow := a.EPSILON(b.THEN(c)).Build()
+	if !finishes(flow, []string{A, B, C}) {
+		t.Errorf("expected epsilon to lead on to the next flow")
+	}
+	if finishes(flow, []string{A, C}) || finishes(flow, []string{B, C}) {
+		t.Errorf("expected epsilon not to skip any tests")
+	}
+}
+
+func TestEPSILONClosure(t *testing.T) {
+	var fired []string
+	record := func(label string) Action {
+		return func(data EventData) {
+			fired = append(fired, label)
+		}
+	}
+
+	// A chain of states linked only by epsilon transitions after a
+	chain := a.state().DO(record("first")).EPSILON(new(State).DO(record("second"))).EPSILON(new(State).DO(record("third")))
+	flow := chain.Build()
+
+	state := flow.Advance(A)
+	if len(fired) != 3 || fired[0] != "first" || fired[1] != "second" || fired[2] != "third" {
+		t.Errorf("expected actions of the whole closure to fire in order, got %v", fired)
+	}
+	if !state.Finished() || !state.Completed() {
+		t.Errorf("expected closure without consuming transitions to be finished and completed")
+	}
+
+	flow = a.EPSILON(new(State)).EPSILON(b).Build()
+	state = flow.Advance(A)
+	if len(state.closure()) != 3 || state.Finished() {
+		t.Errorf("expected closure across the chain to reach b")
+	}
+	if !state.Advance(B).Finished() {
+		t.Errorf("expected event to advance from the end of the closure")
+	}
+	if moves := state.moves(); len(moves) != 1 || moves[0].epsilon {
+		t.Errorf("expected moves to be the consuming transitions of the closure")
+	}
+}
+
+func TestEPSILONInOR(t *testing.T) {
+	flow := a.EPSILON(b).OR(a.EPSILON(c)).Build()
+	for _, events := range [][]string{{A, B}, {A, C}} {
+		if !finishes(flow, events) {
+			t.Errorf("expected %v to finish", events)
+		}
+	}
+}
+
+func TestOPTIONAL(t *testing.T) {
+	flow := a.THEN(b.OPTIONAL()).THEN(c).Build()
+	if !finishes(flow, []string{A, B, C}) {
+		t.Errorf("expected flow to finish with the optional step present")
+	}
+	if !finishes(flow, []string{A, C}) {
+		t.Errorf("expected flow to finish with the optional step absent")
+	}
+	if finishes(flow, []string{A, B}) || finishes(flow, []string{B, C}) {
+		t.Errorf("expected the other steps to be required")
+	}
+	if state := flow.Advance(A).Advance(C); state == flow.Advance(A) {
+		t.Errorf("expected single event to skip the optional step")
+	}
+
+	chain := a.THEN(b.THEN(c).OPTIONAL()).THEN(d).Build()
+	for _, events := range [][]string{{A, B, C, D}, {A, D}} {
+		if !finishes(chain, events) {
+			t.Errorf("expected %v to finish", events)
+		}
+	}
+	if finishes(chain, []string{A, B, D}) {
+		t.Errorf("expected optional flow to be passed through whole or skipped")
+	}
+
+	if !finishes(a.OPTIONAL().THEN(b).Build(), []string{B}) {
+		t.Errorf("expected optional root step to be skippable")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+// Equal checks whether the built flows containing the given States have the
+// same structure with the same IDs, so that IDs saved while running one of
+// them can be used to resume runs on the other (see FindByID).  Transitions
+// must match in the order in which Advance tries them and have the same
+// Tests (see Keyer), permissions and epsilon transitions, and States must
+// have the same outcomes.  The ends shared by the branches of ORs and ANDs
+// must be shared the same way in both flows.
+func Equal(a, b *State) bool {
+	return EqualFunc(a, b, nil)
+}
+
+// EqualFunc checks the same as Equal, except that it uses the given function
+// to decide whether two Tests are the same, or sameTest if it is nil.
+func EqualFunc(a, b *State, same func(x, y Test) bool) bool {
+	return equalFlows(a, b, same, true)
+}
+
+// EqualTopology checks whether the flows containing the given States have
+// the same structure, the same as EqualFunc, but ignores their IDs and the
+// order of the transitions out of each State.  So a.OR(b) and b.OR(a) are
+// equal in topology, although they aren't Equal, since Advance tries their
+// Tests in different orders.  Where a State has several transitions with
+// the same Test, they are matched in order.
+func EqualTopology(a, b *State, same func(x, y Test) bool) bool {
+	return equalFlows(a, b, same, false)
+}
+
+// equalFlows walks the flows containing the given States in step, pairing
+// up their States, and checks that the pairs match.  If ordered is true,
+// the IDs of paired States must match and their transitions are paired in
+// order.  Otherwise, each transition is paired with the first unpaired
+// transition that matches it.
+func equalFlows(a, b *State, same func(x, y Test) bool, ordered bool) bool {
+	if same == nil {
+		same = sameTest
+	}
+	pairs := make(map[*State]*State)
+	paired := make(map[*State]bool)
+	pending := [][2]*State{{a.root(), b.root()}}
+	for len(pending) > 0 {
+		x, y := pending[len(pending)-1][0], pending[len(pending)-1][1]
+		pending = pending[:len(pending)-1]
+		if pairs[x] != nil || paired[y] {
+			// Shared States must be shared the same way in both flows
+			if pairs[x] != y {
+				return false
+			}
+			continue
+		}
+		pairs[x], paired[y] = y, true
+
+		if ordered && x.ID != y.ID {
+			return false
+		}
+		if x.outcome != y.outcome || len(x.out) != len(y.out) || len(x.lazy) != len(y.lazy) {
+			return false
+		}
+		if x.until.isZero() != y.until.isZero() || !x.until.isZero() && !same(x.until, y.until) {
+			return false
+		}
+		used := make([]bool, len(y.out))
+		for i, trans := range x.out {
+			match := -1
+			if ordered {
+				if sameTransition(trans, y.out[i], same) {
+					match = i
+				}
+			} else {
+				for j, other := range y.out {
+					if !used[j] && sameTransition(trans, other, same) {
+						match = j
+						break
+					}
+				}
+			}
+			if match < 0 {
+				return false
+			}
+			used[match] = true
+			pending = append(pending, [2]*State{trans.to, y.out[match].to})
+		}
+		for i, branch := range x.lazy {
+			pending = append(pending, [2]*State{branch, y.lazy[i]})
+		}
+	}
+	return true
+}
+
+// sameTransition checks whether the given transitions have the same Test,
+// according to same, and the same permission, and are both epsilon
+// transitions or neither.
+func sameTransition(trans, other *transition, same func(x, y Test) bool) bool {
+	if trans.epsilon != other.epsilon || trans.perm != other.perm {
+		return false
+	}
+	if trans.test.isZero() || other.test.isZero() {
+		return trans.test.isZero() && other.test.isZero()
+	}
+	return same(trans.test, other.test)
+}
@@ -0,0 +1,50 @@
+package gflow
+
+import (
+	"testing"
+)
+
+func TestEqual(t *testing.T) {
+	if !Equal(a.THEN(b).OR(c).Build(), a.THEN(b).OR(c).Build()) {
+		t.Errorf("expected flows defined the same way to be equal")
+	}
+	ab, ba := a.OR(b).Build(), b.OR(a).Build()
+	if Equal(ab, ba) {
+		t.Errorf("expected a.OR(b) and b.OR(a) to differ")
+	}
+	if !EqualTopology(ab, ba, nil) {
+		t.Errorf("expected a.OR(b) and b.OR(a) to have the same topology")
+	}
+
+	reordered := c.OR(a.THEN(b)).Build()
+	if Equal(a.THEN(b).OR(c).Build(), reordered) || !EqualTopology(a.THEN(b).OR(c).Build(), reordered, nil) {
+		t.Errorf("expected reordered OR to differ only by IDs and order")
+	}
+	if EqualTopology(a.THEN(b).Build(), a.THEN(c).Build(), nil) || EqualTopology(a.THEN(b).Build(), a.state().Build(), nil) {
+		t.Errorf("expected flows with different tests or lengths to differ")
+	}
+	if EqualTopology(a.OR(b).Build(), separateEnds(a, b), nil) {
+		t.Errorf("expected the shared end of an OR to be told apart from separate ends")
+	}
+}
+
+func TestEqualFunc(t *testing.T) {
+	byName := func(x, y Test) bool {
+		return TestName(x) == TestName(y)
+	}
+	first := NamedTest("submit", a).THEN(NamedTest("approve", b)).Build()
+	second := NamedTest("submit", c).THEN(NamedTest("approve", d)).Build()
+	if Equal(first, second) || !EqualFunc(first, second, byName) {
+		t.Errorf("expected Tests to be compared with the given function")
+	}
+}
+
+// separateEnds builds a flow that branches on first and second like an OR,
+// but ends each branch at a State of its own.
+func separateEnds(first, second Test) *State {
+	builder := NewFlowBuilder()
+	builder.AddTransition(builder.Root(), builder.AddState(), first)
+	builder.AddTransition(builder.Root(), builder.AddState(), second)
+	flow, _ := builder.Build()
+	return flow
+}
@@ -0,0 +1,392 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TestNamer names Tests for exporting flows, since Tests have no names of
+// their own.
+type TestNamer func(test Test) string
+
+// textClause matches a single transition in the text format.
+var textClause = regexp.MustCompile(`^(\d+)\s+-(.+)->\s+(\d+)$`)
+
+// textEpsilon stands in for the test name of epsilon transitions in the text
+// format.
+const textEpsilon = "(epsilon)"
+
+// textLink stands in for the test name of untested transitions, such as the
+// links of lazily evaluated ANDs, in the text format.
+const textLink = "(link)"
+
+/*
+   ToText exports the structure of the built flow containing the given State
+   in a compact text format, listing each transition as
+
+   <from ID> -<test name>-> <to ID>
+
+   with transitions separated by "; ".  For example, a.THEN(b).OR(c) built
+   and exported with a namer that names Tests after their variables is
+
+   1 -a-> 2; 1 -c-> 5; 2 -b-> 5; 2 -c-> 5
+
+   A State with several outbound transitions simply appears on the left of
+   several of them.  Epsilon transitions (see EPSILON) are written with the
+   name (epsilon) in place of a test name, and untested transitions with
+   the name (link), the same as by Canonical.  Test names may not contain
+   "->" or ";" and may not be (epsilon) or (link).  Actions, outcomes and
+   permissions are not exported, and lazily evaluated ANDs are exported in
+   full.  Guards (see THENIf) wrap functions and can't be exported, so
+   ToText returns an error for flows that use them rather than exporting a
+   flow that would take the transitions they veto.
+*/
+func (state *State) ToText(namer TestNamer) (string, error) {
+	root := state.eager().root()
+	if root != state.root() {
+		root.Build()
+	}
+	if err := root.checkUnguarded(); err != nil {
+		return "", err
+	}
+	var clauses []string
+	root.each(func(s *State) {
+		for _, trans := range s.out {
+			name := textEpsilon
+			if trans.test.isZero() && !trans.epsilon {
+				name = textLink
+			} else if !trans.epsilon {
+				name = namer(trans.test)
+			}
+			clauses = append(clauses, fmt.Sprintf("%d -%s-> %d", s.ID, name, trans.to.ID))
+		}
+	})
+	return strings.Join(clauses, "; "), nil
+}
+
+// checkUnguarded returns an error naming the first transition of the flow
+// starting at the given root that has a Guard, which can't be exported.
+func (root *State) checkUnguarded() error {
+	var err error
+	root.each(func(s *State) {
+		for _, trans := range s.out {
+			if err == nil && trans.guard != nil {
+				err = fmt.Errorf("transition from state %d to state %d has a guard, which can't be exported", s.ID, trans.to.ID)
+			}
+		}
+	})
+	return err
+}
+
+// FromText parses a flow exported by ToText, looking up the Tests for its
+// transitions by name in the given map, and returns the built root of the
+// flow.  It returns an error if the transitions form a cycle or leave any
+// State unreachable from the root, neither of which Build supports.
+func FromText(text string, tests map[string]Test) (*State, error) {
+	states := make(map[int]*State)
+	stateFor := func(id int) *State {
+		state := states[id]
+		if state == nil {
+			state = new(State)
+			states[id] = state
+		}
+		return state
+	}
+
+	var first *State
+	for _, clause := range strings.Split(text, ";") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		match := textClause.FindStringSubmatch(clause)
+		if match == nil {
+			return nil, fmt.Errorf("unable to parse transition %q", clause)
+		}
+		trans := &transition{epsilon: true}
+		if name := strings.TrimSpace(match[2]); name == textLink {
+			trans = new(transition)
+		} else if name != textEpsilon {
+			test, ok := tests[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown test %q in transition %q", match[2], clause)
+			}
+			trans = &transition{test: test}
+		}
+		fromID, _ := strconv.Atoi(match[1])
+		toID, _ := strconv.Atoi(match[3])
+		from, to := stateFor(fromID), stateFor(toID)
+		if first == nil {
+			first = from
+		}
+		from.addOut(trans)
+		to.addIn(trans)
+	}
+
+	if first == nil {
+		return new(State).Build(), nil
+	}
+	// The transitions may form a cycle, which Build doesn't support, and
+	// which may leave the flow without a root to start from
+	root, err := first.BuildSafe()
+	if err != nil {
+		return nil, err
+	}
+	reachable := make(map[*State]bool)
+	root.each(func(s *State) {
+		reachable[s] = true
+	})
+	for id, state := range states {
+		if !reachable[state] {
+			return nil, fmt.Errorf("state %d is not reachable from state %d", id, fromTextID(states, root))
+		}
+	}
+	return root, nil
+}
+
+// fromTextID finds the ID under which the given State was parsed.
+func fromTextID(states map[int]*State, state *State) int {
+	for id, s := range states {
+		if s == state {
+			return id
+		}
+	}
+	return 0
+}
+
+/*
+   Canonical returns a canonical text snapshot of the full structure of the
+   flow containing the given State, for comparing against a golden copy in
+   tests.  Flows with the same shape that use their Tests in the same places
+   have the same snapshot, regardless of their IDs.  Each State is written
+   on a line of its own as
+
+   <number> [<attributes>]: <test> -> <number>, ...
+
+   States are numbered in the order they are first reached from the root,
+   independently of their IDs.  Tests are named by their names (see
+   NamedTest) or keys (see Keyer) or else t1, t2 ... in the order they are
+   first encountered.  The attributes note the AND group a State belongs to
+   (see SameAndGroup), how many flows were anded to reach it, how many
+   branches it evaluates lazily, whether it has actions and its outcome, if
+   any.  Transitions note their permission in parentheses and their
+   provenance (see Provenance) in square brackets.  For example, the
+   snapshot of a.AND(b).DO(action) is
+
+   1 [and 3]: t1 -> 2, t2 -> 4
+   2 [and 3]: t2 -> 3
+   3 [anded 2, actions]:
+   4 [and 3]: t1 -> 3
+*/
+func (state *State) Canonical() string {
+	numbers := make(map[*State]int)
+	var states []*State
+	state.root().each(func(s *State) {
+		states = append(states, s)
+		numbers[s] = len(states)
+	})
+
+	testName := numberingNamer()
+
+	var lines []string
+	for _, s := range states {
+		var attributes []string
+		if s.andGroup != nil {
+			attributes = append(attributes, fmt.Sprintf("and %d", numbers[s.andGroup]))
+		}
+		if len(s.andedStates) > 0 {
+			attributes = append(attributes, fmt.Sprintf("anded %d", len(s.andedStates)))
+		}
+		if len(s.lazy) > 0 {
+			attributes = append(attributes, fmt.Sprintf("lazy %d", len(s.lazy)))
+		}
+		if s.barrier {
+			attributes = append(attributes, "barrier")
+		}
+		if s.fallback {
+			attributes = append(attributes, "fallback")
+		}
+		if len(s.actions) > 0 {
+			attributes = append(attributes, "actions")
+		}
+		if s.outcome != "" {
+			attributes = append(attributes, fmt.Sprintf("outcome %q", s.outcome))
+		}
+
+		var transitions []string
+		for _, trans := range s.out {
+			name := "(link)"
+			if trans.epsilon {
+				name = "(epsilon)"
+			} else if !trans.test.isZero() {
+				name = testName(trans.test)
+			}
+			if trans.perm != "" {
+				name += fmt.Sprintf(" (%s)", trans.perm)
+			}
+			if trans.source != "" {
+				name += fmt.Sprintf(" [%s]", trans.source)
+			}
+			transitions = append(transitions, fmt.Sprintf("%s -> %d", name, numbers[trans.to]))
+		}
+
+		line := fmt.Sprint(numbers[s])
+		if len(attributes) > 0 {
+			line += " [" + strings.Join(attributes, ", ") + "]"
+		}
+		line += ":"
+		if len(transitions) > 0 {
+			line += " " + strings.Join(transitions, ", ")
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// numberingNamer returns a TestNamer that names Tests by their names (see
+// NamedTest) or keys (see Keyer), or else t1, t2 ... in the order in which it
+// is asked to name them.
+func numberingNamer() TestNamer {
+	var tests []Test
+	return func(test Test) string {
+		if testName := label(test); testName != "" {
+			return testName
+		}
+		for i, t := range tests {
+			if t == test {
+				return fmt.Sprintf("t%d", i+1)
+			}
+		}
+		tests = append(tests, test)
+		return fmt.Sprintf("t%d", len(tests))
+	}
+}
+
+// DumpGraph returns the snapshot of the flow containing the given State
+// written by Canonical.
+//
+// Deprecated: Use Canonical instead.
+func DumpGraph(state *State) string {
+	return state.Canonical()
+}
+
+/*
+   ToDot exports the structure of the built flow containing the given State
+   as a Graphviz DOT digraph, for visualizing the graphs built by the
+   operators.  Each State is a node labeled with its ID, drawn as a double
+   circle if it is Finished, and each transition is an edge labeled with the
+   name that namer gives its Test.  If namer is nil, Tests are named as by
+   Canonical.  Permissions follow the test name in parentheses and
+   provenance (see Provenance) in square brackets, epsilon transitions are
+   labeled "(epsilon)", and lazily evaluated ANDs are exported in full.  A
+   position inside a lazily evaluated AND is exported along with the rest of
+   the flow from there (see Fork).  For example, a.THEN(b) built and exported with a namer that names Tests after
+   their variables is
+
+   digraph flow {
+       1 [label="1" shape=circle];
+       1 -> 2 [label="a"];
+       2 [label="2" shape=circle];
+       2 -> 3 [label="b"];
+       3 [label="3" shape=doublecircle];
+   }
+*/
+func ToDot(state *State, namer TestNamer) string {
+	root := state.eager().root()
+	if root != state.root() {
+		root.Build()
+	}
+	if namer == nil {
+		namer = numberingNamer()
+	}
+	lines := []string{"digraph flow {"}
+	root.each(func(s *State) {
+		shape := "circle"
+		if s.Finished() {
+			shape = "doublecircle"
+		}
+		lines = append(lines, fmt.Sprintf("    %d [label=\"%d\" shape=%s];", s.ID, s.ID, shape))
+		for _, trans := range s.out {
+			lines = append(lines, fmt.Sprintf("    %d -> %d [label=%s];", s.ID, trans.to.ID, strconv.Quote(trans.label(namer))))
+		}
+	})
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n")
+}
+
+/*
+   ToMermaid exports the structure of the built flow containing the given
+   State as a Mermaid flowchart, which GitHub renders when it is pasted into
+   a Markdown document in a mermaid code block.  Each State is a circular
+   node identified by "s" followed by its ID, and each transition is an edge
+   labeled the same as by ToDot.
+
+   Finished States are drawn as double circles of the class "finished".
+   Each State is drawn once, so the end that the branches of an OR or AND
+   share is a single node, whereas branches that keep ends of their own for
+   their outcomes (see Outcome) are drawn with an end each, even if their
+   outcomes have the same name.  The outcome, if any, follows the ID of the
+   end.  For example, a.THEN(b).OR(c) built and exported with a
+   namer that names Tests after their variables is
+
+   flowchart TD
+       classDef finished stroke-width:4px
+       s1((1))
+       s1 -->|"a"| s2
+       s1 -->|"c"| s5
+       s2((2))
+       s2 -->|"b"| s5
+       s2 -->|"c"| s5
+       s5(((5))):::finished
+*/
+func ToMermaid(state *State, namer TestNamer) string {
+	root := state.eager().root()
+	if root != state.root() {
+		root.Build()
+	}
+	if namer == nil {
+		namer = numberingNamer()
+	}
+	lines := []string{"flowchart TD", "    classDef finished stroke-width:4px"}
+	root.each(func(s *State) {
+		if !s.Finished() {
+			lines = append(lines, fmt.Sprintf("    s%d((%d))", s.ID, s.ID))
+		} else if s.outcome == "" {
+			lines = append(lines, fmt.Sprintf("    s%d(((%d))):::finished", s.ID, s.ID))
+		} else {
+			lines = append(lines, fmt.Sprintf("    s%d(((%s))):::finished", s.ID, mermaidQuote(fmt.Sprintf("%d %s", s.ID, s.outcome))))
+		}
+		for _, trans := range s.out {
+			lines = append(lines, fmt.Sprintf("    s%d -->|%s| s%d", s.ID, mermaidQuote(trans.label(namer)), trans.to.ID))
+		}
+	})
+	return strings.Join(lines, "\n")
+}
+
+// mermaidQuote quotes the given text for use as a label in a Mermaid
+// flowchart, which has no escape for double quotes other than an entity.
+func mermaidQuote(text string) string {
+	return `"` + strings.Replace(text, `"`, "#quot;", -1) + `"`
+}
+
+// label describes the given transition for exported graphs, naming its Test
+// with the given namer and following the name with its permission and
+// provenance, if any.
+func (trans *transition) label(namer TestNamer) string {
+	name := "(epsilon)"
+	if !trans.epsilon {
+		name = namer(trans.test)
+	}
+	if trans.perm != "" {
+		name += fmt.Sprintf(" (%s)", trans.perm)
+	}
+	if trans.source != "" {
+		name += fmt.Sprintf(" [%s]", trans.source)
+	}
+	return name
+}
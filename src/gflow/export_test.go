@@ -0,0 +1,264 @@
+package gflow
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+var testNames = map[string]Test{"a": a, "b": b, "c": c, "d": d}
+
+func nameTest(test Test) string {
+	for name, t := range testNames {
+		if t == test {
+			return name
+		}
+	}
+	return "?"
+}
+
+// toText exports the given flow with ToText, failing the test if it can't.
+func toText(t *testing.T, flow *State) string {
+	text, err := flow.ToText(nameTest)
+	if err != nil {
+		t.Fatalf("unable to export flow: %s", err)
+	}
+	return text
+}
+
+func TestTextRoundTrip(t *testing.T) {
+	flow := a.THEN(b).OR(c.AND(d)).Build()
+	text := toText(t, flow)
+
+	parsed, err := FromText(text, testNames)
+	if err != nil {
+		t.Fatalf("unable to parse %q: %s", text, err)
+	}
+	if toText(t, parsed) != text {
+		t.Errorf("round trip changed %q into %q", text, toText(t, parsed))
+	}
+	for _, steps := range [][]string{{A, B}, {D, C}, {C, A, D}} {
+		if !finishes(parsed, steps) {
+			t.Errorf("parsed flow did not complete for %s", steps)
+		}
+	}
+}
+
+func TestTextRoundTripEpsilon(t *testing.T) {
+	golden := []struct {
+		flow  *State
+		steps []string
+	}{
+		{a.EPSILON(b.THEN(c)), []string{A, B, C}},
+		{SWITCH([]Case{{a, b}, {c, nil}}, d), []string{C, D}},
+		{a.THEN(b.OPTIONAL()).THEN(c), []string{A, C}},
+	}
+	for _, g := range golden {
+		text := toText(t, g.flow.Build())
+		if !strings.Contains(text, "-(epsilon)->") {
+			t.Errorf("expected epsilon transition to be marked in %q", text)
+		}
+		parsed, err := FromText(text, testNames)
+		if err != nil {
+			t.Fatalf("unable to parse %q: %s", text, err)
+		}
+		if toText(t, parsed) != text {
+			t.Errorf("round trip changed %q into %q", text, toText(t, parsed))
+		}
+		if !finishes(parsed, g.steps) {
+			t.Errorf("parsed flow %q did not complete for %s", text, g.steps)
+		}
+	}
+}
+
+func TestToText(t *testing.T) {
+	expected := "1 -a-> 2; 1 -c-> 5; 2 -b-> 5; 2 -c-> 5"
+	if text := toText(t, a.THEN(b).OR(c).Build()); text != expected {
+		t.Errorf("expected %q, got %q", expected, text)
+	}
+}
+
+func TestToTextGuard(t *testing.T) {
+	veto := func(data EventData) bool {
+		return false
+	}
+	flow := a.THENIf(veto, b).Build()
+	if text, err := flow.ToText(nameTest); err == nil {
+		t.Errorf("expected error for guarded flow, got %q", text)
+	}
+	if finishes(flow, []string{A, B}) {
+		t.Errorf("guarded flow completed despite its guard")
+	}
+}
+
+func TestTextLink(t *testing.T) {
+	text := "1 -a-> 2; 2 -(link)-> 3; 3 -b-> 4"
+	parsed, err := FromText(text, testNames)
+	if err != nil {
+		t.Fatalf("unable to parse %q: %s", text, err)
+	}
+	if link := parsed.out[0].to.out[0]; !link.test.isZero() || link.epsilon {
+		t.Errorf("expected (link) to be parsed as an untested transition")
+	}
+	if exported := toText(t, parsed); exported != text {
+		t.Errorf("round trip changed %q into %q", text, exported)
+	}
+}
+
+func TestFromTextErrors(t *testing.T) {
+	if _, err := FromText("1 -a-> 2; 2 -x-> 3", testNames); err == nil {
+		t.Errorf("expected error for unknown test")
+	}
+	if _, err := FromText("1 -a-> 2; 2 to 3", testNames); err == nil {
+		t.Errorf("expected error for malformed transition")
+	}
+	if _, err := FromText("1 -a-> 2; 3 -b-> 4", testNames); err == nil {
+		t.Errorf("expected error for unreachable state")
+	}
+	if _, err := FromText("1 -a-> 2; 3 -b-> 4; 4 -c-> 3", testNames); err == nil {
+		t.Errorf("expected error for unreachable cycle")
+	}
+	for _, text := range []string{"1 -a-> 2; 2 -b-> 1", "1 -a-> 2; 2 -b-> 3; 3 -c-> 2"} {
+		if _, err := FromText(text, testNames); err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Errorf("expected error for cyclic transitions %q, got %v", text, err)
+		}
+	}
+}
+
+func TestCanonicalSnapshot(t *testing.T) {
+	noop := func(data EventData) {}
+	golden := []struct {
+		label    string
+		flow     *State
+		expected string
+	}{
+		{"a.THEN(b)", a.THEN(b),
+			"1: t1 -> 2\n" +
+				"2: t2 -> 3\n" +
+				"3:"},
+		{"a.OR(b)", a.OR(b),
+			"1: t1 -> 2, t2 -> 2\n" +
+				"2:"},
+		{"a.THEN(b).OR(a.THEN(c))", a.THEN(b).OR(a.THEN(c)),
+			"1: t1 -> 2\n" +
+				"2: t2 -> 3, t3 -> 3\n" +
+				"3:"},
+		{"a.AND(b).DO(noop)", a.AND(b).DO(noop),
+			"1 [and 3]: t1 -> 2, t2 -> 4\n" +
+				"2 [and 3]: t2 -> 3\n" +
+				"3 [anded 2, actions]:\n" +
+				"4 [and 3]: t1 -> 3"},
+		{"a.LAZYAND(b).THEN(c)", a.LAZYAND(b).THEN(c),
+			"1 [lazy 2]: (link) -> 2\n" +
+				"2 [anded 2]: t1 -> 3\n" +
+				"3:"},
+		{"a.Outcome(\"x\").OR(b)", a.Outcome("x").OR(b),
+			"1: t1 -> 2, t2 -> 3\n" +
+				"2 [outcome \"x\"]:\n" +
+				"3:"},
+		{"a.THENAuth(b, \"p\")", a.THENAuth(b, "p"),
+			"1: t1 -> 2\n" +
+				"2: t2 (p) -> 3\n" +
+				"3:"},
+		{"Equals(A).THEN(b)", Equals(A).THEN(b),
+			"1: Equals(string(\"A\")) -> 2\n" +
+				"2: t1 -> 3\n" +
+				"3:"},
+	}
+	for _, g := range golden {
+		if snapshot := g.flow.Canonical(); snapshot != g.expected {
+			t.Errorf("snapshot of %s is\n%s\nexpected\n%s", g.label, snapshot, g.expected)
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	if a.THEN(b).Canonical() != c.THEN(d).Canonical() {
+		t.Errorf("expected flows of the same shape to have the same snapshot")
+	}
+	if a.THEN(a).Canonical() == a.THEN(b).Canonical() {
+		t.Errorf("expected snapshot to distinguish repeated tests")
+	}
+	if flow := a.AND(b); DumpGraph(flow) != flow.Canonical() {
+		t.Errorf("expected DumpGraph to write the same snapshot as Canonical")
+	}
+}
+
+// TestCanonicalGolden locks down the graphs built for the flows in the test
+// table.  Run with -update to rewrite testdata/canonical.golden after an
+// intended change to the operators.
+func TestCanonicalGolden(t *testing.T) {
+	var entries []string
+	for _, test := range tests {
+		entries = append(entries, "== "+test.label+"\n"+test.flow.Build().Canonical()+"\n")
+	}
+	actual := strings.Join(entries, "\n")
+
+	golden := "testdata/canonical.golden"
+	if *update {
+		if err := ioutil.WriteFile(golden, []byte(actual), 0644); err != nil {
+			t.Fatalf("unable to update %s: %s", golden, err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("unable to read %s: %s", golden, err)
+	}
+	if actual != string(expected) {
+		t.Errorf("canonical forms differ from %s:\n%s", golden, actual)
+	}
+}
+
+func TestToDot(t *testing.T) {
+	expected := "digraph flow {\n" +
+		"    1 [label=\"1\" shape=circle];\n" +
+		"    1 -> 2 [label=\"a\"];\n" +
+		"    1 -> 5 [label=\"c\"];\n" +
+		"    2 [label=\"2\" shape=circle];\n" +
+		"    2 -> 5 [label=\"b\"];\n" +
+		"    2 -> 5 [label=\"c\"];\n" +
+		"    5 [label=\"5\" shape=doublecircle];\n" +
+		"}"
+	if dot := ToDot(a.THEN(b).OR(c).Build(), nameTest); dot != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, dot)
+	}
+	if dot := ToDot(Equals(A).THEN(b).Build(), nil); !strings.Contains(dot, `[label="Equals(string(\"A\"))"]`) || !strings.Contains(dot, `[label="t1"]`) {
+		t.Errorf("expected tests to be named by key or number without a namer, got\n%s", dot)
+	}
+	if dot := ToDot(a.LAZYAND(b).THEN(c).Build().Advance(A), nameTest); !strings.Contains(dot, `[label="b"]`) || !strings.Contains(dot, "shape=doublecircle") {
+		t.Errorf("expected position inside lazy AND to export the rest of the flow, got\n%s", dot)
+	}
+}
+
+func TestToMermaid(t *testing.T) {
+	expected := "flowchart TD\n" +
+		"    classDef finished stroke-width:4px\n" +
+		"    s1((1))\n" +
+		"    s1 -->|\"a\"| s2\n" +
+		"    s1 -->|\"c\"| s5\n" +
+		"    s2((2))\n" +
+		"    s2 -->|\"b\"| s5\n" +
+		"    s2 -->|\"c\"| s5\n" +
+		"    s5(((5))):::finished"
+	if mermaid := ToMermaid(a.THEN(b).OR(c).Build(), nameTest); mermaid != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, mermaid)
+	}
+
+	flow := a.Outcome("done").OR(b.THEN(c).Outcome("done")).OR(d.Outcome("failed")).Build()
+	mermaid := ToMermaid(flow, nameTest)
+	if strings.Count(mermaid, ":::finished") != 3 || strings.Count(mermaid, ` done"))):::finished`) != 2 {
+		t.Errorf("expected each branch to keep its own end, got\n%s", mermaid)
+	}
+	if !strings.Contains(mermaid, `((("`) || !strings.Contains(mermaid, ` done"))):::finished`) {
+		t.Errorf("expected ends to be labeled with their outcomes, got\n%s", mermaid)
+	}
+	if mermaid := ToMermaid(a.LAZYAND(b).Build().Advance(A), nameTest); !strings.Contains(mermaid, `|"b"|`) {
+		t.Errorf("expected position inside lazy AND to export the rest of the AND, got\n%s", mermaid)
+	}
+	if mermaid := ToMermaid(NamedTest(`say "hi"`, a).state().Build(), nil); !strings.Contains(mermaid, `|"say #quot;hi#quot;"|`) {
+		t.Errorf("expected quotes in labels to be escaped, got\n%s", mermaid)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+/*
+   Fallback constructs a flow that runs primary and offers every event that
+   primary ignores to secondary instead.  Each event advances at most one of
+   the two flows, and primary is always offered the event first.
+
+   The flow finishes as soon as primary finishes, regardless of how far
+   secondary has got, so secondary can only ever handle the events that
+   arrive while primary is still running.  If secondary finishes first, the
+   flow carries on with primary alone, and events that primary ignores are
+   then ignored by the flow as a whole.
+
+   As with AND, Actions registered inside primary or secondary don't fire
+   within the combined flow, whereas OnEnter hooks do.
+
+   Like LAZYAND, Fallback keeps a cursor into each flow while advancing, so
+   the positions inside it have no ID.  Combining a Fallback using OR or AND
+   builds it out in full, at which point primary is preferred only over
+   those Tests of secondary that Build doesn't order ahead of it by priority
+   or cost (see Prioritizer and Coster).
+*/
+func (primary *State) Fallback(secondary stateSource) *State {
+	// Create a common start node
+	start := new(State)
+	// Create a common end node
+	end := new(State)
+
+	start.fallback = true
+	start.kind, end.kind = KindFallbackStart, KindFallbackEnd
+	start.lazy = []*State{primary.root(), secondary.state().root()}
+	link := &transition{from: start, to: end}
+	start.addOut(link)
+	end.addIn(link)
+
+	return end
+}
+
+func (test Test) Fallback(secondary stateSource) *State {
+	return test.state().Fallback(secondary)
+}
+
+// addFallbackStates builds out in full the flow of a Fallback from the given
+// positions in its primary and secondary flows, with the transitions of
+// primary ahead of those of secondary.
+func (state *State) addFallbackStates(primary, secondary, end *State) {
+	if primary.Finished() {
+		for _, trans := range state.in {
+			// Switch the transition to terminate at the end state
+			end.addIn(trans)
+		}
+		return
+	}
+	for _, trans := range primary.out {
+		next := new(State)
+		newTrans := trans.clone(state, next)
+		state.addOut(newTrans)
+		next.addIn(newTrans)
+		next.addFallbackStates(trans.to, secondary, end)
+	}
+	for _, trans := range secondary.out {
+		next := new(State)
+		newTrans := trans.clone(state, next)
+		state.addOut(newTrans)
+		next.addIn(newTrans)
+		next.addFallbackStates(primary, trans.to, end)
+	}
+}
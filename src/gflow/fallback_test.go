@@ -0,0 +1,76 @@
+package gflow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFallback(t *testing.T) {
+	var handled []string
+	record := func(name string) Action {
+		return func(data EventData) {
+			handled = append(handled, name+data.(string))
+		}
+	}
+	primary := a.THEN(b.OnEnter(record("primary"))).THEN(c)
+	secondary := d.OnEnter(record("fallback")).THEN(makeTest(E).OnEnter(record("fallback")))
+	flow := primary.Fallback(secondary).Build()
+
+	state := flow
+	for _, event := range []string{A, D, B, E, C} {
+		state = state.Advance(event)
+	}
+	if !state.Finished() {
+		t.Errorf("expected flow to finish once primary finished")
+	}
+	if got := strings.Join(handled, " "); got != "fallbackD primaryB fallbackE" {
+		t.Errorf("expected events to alternate between primary and fallback, got %q", got)
+	}
+	if flow.Advance(F) != flow {
+		t.Errorf("expected event ignored by both flows to be ignored")
+	}
+}
+
+func TestFallbackCompletion(t *testing.T) {
+	flow := a.THEN(b).Fallback(d.THEN(c))
+	if !finishes(flow, []string{A, D, B}) {
+		t.Errorf("expected flow to finish with primary while fallback was still running")
+	}
+	if finishes(flow, []string{D, C, A}) {
+		t.Errorf("expected flow not to finish with fallback")
+	}
+	if !finishes(flow, []string{D, C, D, A, B}) {
+		t.Errorf("expected primary to carry on alone once fallback finished")
+	}
+}
+
+func TestFallbackPrefersPrimary(t *testing.T) {
+	offered := 0
+	flow := a.THEN(b).Fallback(a.OnEnter(func(data EventData) {
+		offered++
+	})).Build()
+	state := flow.Advance(A)
+	if offered != 0 {
+		t.Errorf("expected fallback not to be offered events accepted by primary")
+	}
+	if state.Advance(A); offered != 1 {
+		t.Errorf("expected fallback to be offered events ignored by primary")
+	}
+}
+
+func TestFallbackEager(t *testing.T) {
+	lazy := a.THEN(b).Fallback(d.THEN(c))
+	eager := lazy.eager()
+	if eager == lazy {
+		t.Fatalf("expected Fallback to be built out")
+	}
+	sequences := [][]string{{A, B}, {A, D, B}, {D, A, C, B}, {D, C, A}, {D, C, D, A, B}, {C, A, B}}
+	for _, sequence := range sequences {
+		if finishes(eager, sequence) != finishes(lazy, sequence) {
+			t.Errorf("built out Fallback disagrees on %v", sequence)
+		}
+	}
+	if !finishes(lazy.OR(c), []string{C}) || !finishes(lazy.OR(c), []string{D, A, B}) {
+		t.Errorf("expected Fallback to work inside an OR")
+	}
+}
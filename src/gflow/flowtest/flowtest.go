@@ -0,0 +1,29 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+// Package flowtest provides helpers for testing gflow flows.  It's kept
+// apart from package gflow so that programs using flows don't import the
+// testing package.
+package flowtest
+
+import (
+	"gflow"
+	"testing"
+)
+
+// AssertLanguage checks that the given flow accepts each of the sequences of
+// Tests in accepts and rejects each of the sequences in rejects (see
+// State.Accepts), reporting an error through t for each one that it doesn't.
+func AssertLanguage(t testing.TB, flow *gflow.State, accepts [][]gflow.Test, rejects [][]gflow.Test) {
+	t.Helper()
+	for i, tests := range accepts {
+		if !flow.Accepts(tests) {
+			t.Errorf("flow rejects sequence %d of %d tests, expected it to accept it", i, len(tests))
+		}
+	}
+	for i, tests := range rejects {
+		if flow.Accepts(tests) {
+			t.Errorf("flow accepts sequence %d of %d tests, expected it to reject it", i, len(tests))
+		}
+	}
+}
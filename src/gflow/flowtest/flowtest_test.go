@@ -0,0 +1,45 @@
+package flowtest
+
+import (
+	"fmt"
+	"gflow"
+	"testing"
+)
+
+var a gflow.Test = gflow.Equals("A")
+var b gflow.Test = gflow.Equals("B")
+var c gflow.Test = gflow.Equals("C")
+
+// recorder is a testing.TB that records errors rather than failing.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertLanguage(t *testing.T) {
+	AssertLanguage(t, a.THEN(b).THEN(c),
+		[][]gflow.Test{{a, b, c}},
+		[][]gflow.Test{{a, b}, {a, c, b}, {b, a, c}})
+	AssertLanguage(t, a.OR(b.THEN(c)),
+		[][]gflow.Test{{a}, {b, c}},
+		[][]gflow.Test{{b}, {c}, {a, b, c}})
+	AssertLanguage(t, a.AND(b).AND(c),
+		[][]gflow.Test{{a, b, c}, {c, b, a}, {b, a, c}},
+		[][]gflow.Test{{a, b}, {a, a, c}})
+}
+
+func TestAssertLanguageReports(t *testing.T) {
+	r := &recorder{TB: t}
+	AssertLanguage(r, a.THEN(b),
+		[][]gflow.Test{{a, b}, {b, a}},
+		[][]gflow.Test{{a}, {a, b}})
+	if len(r.errors) != 2 {
+		t.Errorf("expected 2 errors, got %v", r.errors)
+	}
+}
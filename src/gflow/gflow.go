@@ -13,7 +13,10 @@
    A flow is a directed acyclic graph of states, sharing the same start and end
    states and connected by one or more transitions from one state to the next.
    Each transition is governed by a single test, which is specified as a
-   function. These tests must be mutually exclusive.
+   function. These tests should be mutually exclusive.  Where several tests
+   pass the same event, the transition whose test has the highest priority is
+   taken (see PriorityTest), followed by the cheapest (see Coster) and then
+   by the first to have been added.
 
    ---------------------------- STRUCTURE OF FLOWS ----------------------------
 
@@ -92,19 +95,19 @@
 
    // This example uses the flow a THEN a THEN b OR (c AND d)
 
-   // Define tests.  Tests are functions that accept an EventData and
-   // return a bool.  EventData is the empty interface, meaning it can be
-   // any type of value.
+   // Define tests.  Tests are created from functions that accept an
+   // EventData and return a bool.  EventData is the empty interface, meaning
+   // it can be any type of value.
 
    // In our example, we're just using strings as our EventData.
 
-   var a gflow.Test = func(data gflow.EventData) bool {
+   var a = gflow.NewTest(func(data gflow.EventData) bool {
        return "A" == data.(string)
-   }
+   })
 
-   var b gflow.Test = func(data gflow.EventData) bool {
+   var b = gflow.NewTest(func(data gflow.EventData) bool {
        return "B" == data.(string)
-   }
+   })
 
    // ... and so on ...
 
@@ -209,28 +212,111 @@
 
    // Logically, these flows are the same, but the id's from these flows cannot
    // be interchanged.  In this case, s1 and s2 are NOT equivalent!
+
+   // Before changing the definition of a flow that has runs in flight, use
+   // Equal to check that the new definition keeps the IDs of the old one.
+
+   compatible := gflow.Equal(flow1, flow2) // false
 */
 package gflow
 
-// Test is any function that tests against a given EventData and returns
-// a bool indicating whether or not the flow is allowed to transition.
-type Test func(data EventData) bool
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Test tests against a given EventData and returns a bool indicating
+// whether or not the flow is allowed to transition.  Tests are created from
+// functions using NewTest.  A Test is a handle to its function that can be
+// compared with ==, which is how the same Test is recognized wherever it's
+// used, for example when OR merges transitions with the same Test.
+type Test struct {
+	def *testDef
+}
+
+// testDef holds the function of a Test along with its Descriptor, if any
+// (see Describe).
+type testDef struct {
+	pass func(data EventData) bool
+	desc Descriptor
+}
+
+// NewTest creates a Test from the given function.  Each call creates a new
+// Test, distinct from every other, so a Test should be created once and
+// then used wherever it's needed.
+func NewTest(pass func(data EventData) bool) Test {
+	return Test{&testDef{pass: pass}}
+}
+
+// Pass evaluates the Test against the given EventData.
+func (test Test) Pass(data EventData) bool {
+	return test.def.pass(data)
+}
+
+// isZero checks whether the given Test is the zero Test, which belongs to
+// the transitions that aren't governed by a Test, such as epsilon
+// transitions.
+func (test Test) isZero() bool {
+	return test.def == nil
+}
 
 // Action is any function that executes at the end of a flow.
 type Action func(data EventData)
 
+// StateAction is an Action that is also handed the State that the run
+// reached, for example to log its ID.  See DOState.
+type StateAction func(state *State, data EventData)
+
 // EventData any object
 type EventData interface{}
 
+// Condition is any function that decides whether an action registered with
+// DOIf fires, based on the Vars of the run.
+type Condition func(vars Vars) bool
+
+// Validator is any function that checks a given EventData before it is
+// tested, returning an error if the EventData is malformed.
+type Validator func(data EventData) error
+
+// Guard is any function that decides, once an event has passed the Test of
+// a transition, whether the transition may be taken, for example by
+// consulting state outside the flow.  See THENIf.
+type Guard func(data EventData) bool
+
+// Equality is any function that decides whether two EventData represent the
+// same event.  See WithEventEquality.
+type Equality func(a, b EventData) bool
+
 // State represents a state in the flow, including inbound and outbound
 // transitions and, if applicable, the Action executed when this State is
 // reached.
 type State struct {
-	ID          int
-	in          []*transition
-	out         []*transition
-	andedStates []*State
-	action      Action
+	ID             int
+	in             []*transition
+	out            []*transition
+	andedStates    []*State
+	actions        []Action
+	conditions     []Condition
+	contextActions []ContextAction
+	stateActions   []StateAction
+	outcome        string
+	lazy           []*State
+	lazily         bool
+	barrier        bool
+	fallback       bool
+	kind           StateKind
+	andGroup       *State
+	validator      Validator
+	equality       Equality
+	weight         int
+	together       bool
+	sla            time.Duration
+	shadows        bool
+	entries        *entryCounts
+	rootCache      *State
+	until          Test
+	ends           []*State
 }
 
 // stateSource is any object that can be converted into a State.
@@ -243,26 +329,143 @@ type stateSource interface {
 // transition represents a transition from one State to another State
 // contingent on a given Test.
 type transition struct {
-	test Test
-	from *State
-	to   *State
+	test      Test
+	perm      string
+	guard     Guard
+	transform Projection
+	epsilon   bool
+	absorbs   bool
+	source    string
+	onEnter   []Action
+	andWidth  int
+	from      *State
+	to        *State
 }
 
 // THEN constructs a sequential flow which terminates when the from and to
 // States are reached in sequence. 
 func (from *State) THEN(to stateSource) *State {
-	newFrom := from.copy()
-	toState := to.state().copy()
-	for _, trans := range toState.root().out {
-		newFrom.addOut(trans)
-	}
-	return toState
+	return from.then(to, "", nil)
 }
 
 func (from Test) THEN(to stateSource) *State {
 	return from.state().THEN(to)
 }
 
+// THENAuth constructs the same flow as THEN, except that the transitions
+// leading into to may only be taken by callers holding the given permission.
+// See AdvanceAs.
+func (from *State) THENAuth(to stateSource, perm string) *State {
+	return from.then(to, perm, nil)
+}
+
+func (from Test) THENAuth(to stateSource, perm string) *State {
+	return from.state().THENAuth(to, perm)
+}
+
+// THENIf constructs the same flow as THEN, except that the transitions
+// leading into to are taken only if the given Guard allows it.  The Guard
+// runs only once an event has passed the Test of a transition, so unlike a
+// Test, it may have side effects or consult state outside the flow, and it
+// can veto the transition.  Since Guards are functions, which can't be
+// compared, OR never merges transitions that have a Guard, even where both
+// have the same one.
+func (from *State) THENIf(guard Guard, to stateSource) *State {
+	return from.then(to, "", guard)
+}
+
+func (from Test) THENIf(guard Guard, to stateSource) *State {
+	return from.state().THENIf(guard, to)
+}
+
+// REPEAT constructs a sequential flow of n copies of the flow ending in the
+// given State, so a.REPEAT(3) is the same as a.THEN(a).THEN(a).  Each copy
+// is separate, so the actions of the repeated flow fire once per copy.  If n
+// is 0 (or less), REPEAT returns a flow that is already finished.
+func (from *State) REPEAT(n int) *State {
+	if n <= 0 {
+		return new(State)
+	}
+	repeated := from.copy()
+	for i := 1; i < n; i++ {
+		repeated = repeated.THEN(from)
+	}
+	return repeated
+}
+
+func (from Test) REPEAT(n int) *State {
+	return from.state().REPEAT(n)
+}
+
+// TIMES constructs a flow that finishes once the given Test has passed n
+// events, which needn't be consecutive, since events that don't pass it are
+// ignored as usual.  For example, a.TIMES(3) finishes on A -> X -> A -> Y ->
+// A.  The flow is a chain of n transitions with the same Test, so each event
+// counts only once (see DoubleCountPoints).  If n is 0 (or less), TIMES
+// returns a flow that is already finished.
+func (test Test) TIMES(n int) *State {
+	state := new(State)
+	for i := 0; i < n; i++ {
+		next := new(State)
+		trans := &transition{test: test}
+		state.addOut(trans)
+		next.addIn(trans)
+		state = next
+	}
+	return state
+}
+
+/*
+   UNTIL constructs a flow that absorbs any number of events passing the
+   given Test until other is reached, so a.UNTIL(b) finishes on B as well as
+   on A -> A -> B.  If an event passes both the Test and the first Test of
+   other, other is advanced.
+
+   Since flows are acyclic, the State waiting for other has no transition
+   back to itself.  Instead, an event that passes the Test while the flow is
+   waiting there triggers a transition created on the spot that leads back
+   to the same State, which is where a loop would lead.  Like any other
+   transition, it counts as advancing the flow (see AdvanceE), but since the
+   flow stays where it is, the actions of the State don't fire again and the
+   State isn't counted as entered again (see CountEntries).  The transition
+   isn't part of the flow, so it doesn't appear in analyses such as
+   NextTests or in exported graphs.
+
+   Only the first State of other absorbs events.  Combining an UNTIL using
+   OR or AND drops the absorbing, leaving the flow to ignore those events
+   instead, which only changes which events count as advancing it.
+*/
+func (test Test) UNTIL(other stateSource) *State {
+	until := other.state().copy()
+	until.root().until = test
+	return until
+}
+
+/*
+   PIPE constructs the same flow as THEN, except that once a run reaches the
+   end of from, every subsequent event is passed through transform before
+   being handed to the Tests and Actions of to.  This allows each stage of a
+   flow to enrich the events seen by later stages.  Transforms accumulate, so
+   a.PIPE(f, b.PIPE(g, c)) hands c the result of g(f(event)).
+
+   The transforms are part of the run rather than of the flow, so only a
+   Runner applies them (see Runner.Advance).  Advancing States directly
+   ignores them.  Events that don't trigger any transition are transformed
+   to be tested but otherwise leave the run unchanged, so they neither reach
+   any Actions nor affect how later events are transformed.
+*/
+func (from *State) PIPE(transform Projection, to stateSource) *State {
+	piped := from.copy()
+	for _, trans := range piped.in {
+		trans.transform = transform
+	}
+	return piped.then(to, "", nil)
+}
+
+func (from Test) PIPE(transform Projection, to stateSource) *State {
+	return from.state().PIPE(transform, to)
+}
+
 /*
    OR constructs a conditional flow which terminates when either the
    state or the other state are reached.
@@ -276,17 +479,45 @@ func (state *State) OR(other stateSource) *State {
 	// Create a common end node
 	end := new(State)
 
-	root := state.root()
-	otherRoot := otherState.root()
+	root := state.eager().root()
+	otherRoot := otherState.eager().root()
+	if otherState.weight > state.weight {
+		root, otherRoot = otherRoot, root
+	}
 
-	start.addOrStates(root, otherRoot, end)
-	return end
+	start.kind, end.kind = KindORStart, KindOREnd
+	start.addOrStates(root, otherRoot, end, make(map[*State]*State), otherState.weight != state.weight)
+	return start.joinEnds(end)
 }
 
 func (test Test) OR(other stateSource) *State {
 	return test.state().OR(other)
 }
 
+/*
+   Weight sets the weight of the branch ending in the given State for when it
+   is combined with another branch using OR.
+
+   When both branches of an OR start with the same test, OR merges them so
+   that the flow can continue along either branch after that test passes.
+   If one of the branches finishes on that test while the other continues,
+   the branch that finishes wins, leaving the rest of the other branch
+   unreachable.  For example, a.OR(a.THEN(c)) finishes on A without waiting
+   for C.
+
+   If the branches have different weights, the heavier branch wins instead,
+   so a.OR(a.THEN(c).Weight(1)) waits for C after A.  OR also evaluates the
+   transitions of the heavier branch first.
+*/
+func (state *State) Weight(weight int) *State {
+	state.weight = weight
+	return state
+}
+
+func (test Test) Weight(weight int) *State {
+	return test.state().Weight(weight)
+}
+
 /*
    AND constructs a flow which terminates when both
    state and other are reached.
@@ -295,6 +526,11 @@ func (test Test) OR(other stateSource) *State {
 */
 func (state *State) AND(other stateSource) *State {
 	otherState := other.state()
+	if state.root().lazily || otherState.root().lazily {
+		end := state.LAZYAND(otherState)
+		end.root().lazily = true
+		return end
+	}
 	// Create a common start node
 	start := new(State)
 	// Create a common end node
@@ -309,9 +545,11 @@ func (state *State) AND(other stateSource) *State {
 
 	andedRoots := make([]*State, len(andedStates))
 	for i, state := range andedStates {
-		andedRoots[i] = state.root()
+		andedRoots[i] = state.eager().root()
 	}
 
+	start.kind, end.kind = KindANDStart, KindANDEnd
+	start.andGroup = end
 	start.addAndStates(andedRoots, end)
 
 	return end
@@ -321,54 +559,757 @@ func (test Test) AND(other stateSource) *State {
 	return test.state().AND(other)
 }
 
-// DO registers the given action to fire when the state is reached.
+// Lazy sets the flow ending in the given State to evaluate its ANDs lazily,
+// so that AND combines it with other flows the same as LAZYAND, without
+// building the interleavings of their branches up front.  Flows are
+// evaluated eagerly by default, which suits small flows best (see LAZYAND).
+// The setting is held by the root of the flow and kept by the flows that
+// AND builds from it, but operators that start a new flow, such as OR,
+// don't carry it over, so it should be set on the flows being ANDed.
+func (state *State) Lazy() *State {
+	state.root().lazily = true
+	return state
+}
+
+func (test Test) Lazy() *State {
+	return test.state().Lazy()
+}
+
+// CompleteTogether configures the AND (or LAZYAND) ending in the given State
+// so that an event that finishes one of its flows also finishes every other
+// flow that it would finish, for example when the flows that remain all end
+// with the same Test.  By default, each event advances only one of the flows
+// of an AND, so a.AND(a) needs two A events, whereas with CompleteTogether it
+// needs one.  Events that don't finish every remaining flow still advance
+// only one of them.  CompleteTogether must be called on the State returned
+// by AND, and a lazily evaluated AND only completes together once built out
+// in full by OR or AND.
+func (state *State) CompleteTogether() *State {
+	state.together = true
+	return state
+}
+
+// DO registers the given action to fire when the state is reached.  Calling
+// DO more than once registers several actions, which fire in the order in
+// which they were registered.
 func (state *State) DO(action Action) *State {
-	state.action = action
+	return state.DOIf(nil, action)
+}
+
+// DOIf registers the given action to fire when the state is reached, but
+// only if cond holds for the Vars of the run reaching it (see Runner.Vars).
+// A nil cond always holds.  Runs that advance without a Runner have no Vars,
+// so cond is passed nil.  Actions registered with DO and DOIf fire in the
+// order in which they were registered.
+func (state *State) DOIf(cond Condition, action Action) *State {
+	for _, s := range state.withEnds() {
+		s.actions = append(s.actions, action)
+		s.conditions = append(s.conditions, cond)
+		s.contextActions = append(s.contextActions, nil)
+		s.stateActions = append(s.stateActions, nil)
+	}
+	return state
+}
+
+// DOState registers the given action to fire when the state is reached, the
+// same as DO, handing it the State that the run reached along with the
+// event.  That's the State that Advance returns, which isn't necessarily the
+// one DOState was called on, since operators such as THEN and OR build new
+// States from copies of those they combine.
+func (state *State) DOState(action StateAction) *State {
+	state.DO(func(data EventData) {
+		action(state, data)
+	})
+	for _, s := range state.withEnds() {
+		s.stateActions[len(s.actions)-1] = action
+	}
+	return state
+}
+
+// OnEnter registers the given action to fire whenever a run moves into the
+// given State along any of its current inbound transitions, whether or not
+// the State is the end of its flow.  Unlike the actions registered with DO,
+// which belong to the State, hooks registered with OnEnter belong to the
+// transitions leading into it, so they survive operators such as OR and AND
+// that build new States in place of those they combine.  When a run moves
+// into a State, its OnEnter hooks fire first, in the order in which they
+// were registered, followed by its actions.  The root of a flow is never
+// moved into, so OnEnter has no effect on it.
+func (state *State) OnEnter(action Action) *State {
+	for _, trans := range state.in {
+		trans.onEnter = append(trans.onEnter, action)
+	}
+	return state
+}
+
+func (test Test) OnEnter(action Action) *State {
+	return test.state().OnEnter(action)
+}
+
+// Outcome labels the given (terminal) State with the named outcome, allowing
+// flows with several meaningful endings to report which one was reached.
+//
+// Unlike unlabeled branches, branches ending in an outcome keep a terminal
+// State of their own when combined with OR, so that the label survives.
+// The State returned by OR still stands for every end of the combined flow,
+// so THEN and DO on it continue from, or fire at, each of the terminals.
+func (state *State) Outcome(name string) *State {
+	state.outcome = name
+	return state
+}
+
+func (test Test) Outcome(name string) *State {
+	return test.state().Outcome(name)
+}
+
+// OutcomeName returns the name of the outcome with which the State was
+// labeled and whether or not it was labeled at all.
+func (state *State) OutcomeName() (string, bool) {
+	return state.outcome, state.outcome != ""
+}
+
+// WithValidator registers the given Validator on every State of the flow.
+// Advance validates each event before testing it and ignores events that
+// fail validation, without taking any transition.  Since operators build new
+// States, WithValidator should be called once the flow is fully composed.
+func (state *State) WithValidator(validator Validator) *State {
+	state.root().each(func(s *State) {
+		s.validator = validator
+	})
 	return state
 }
 
+// WithEventEquality registers the given Equality on every State of the flow,
+// for features that compare the events of a run with EventsEqual to use in
+// place of reflect.DeepEqual, for example to consider only an event's ID.
+// Like WithValidator, it should be called once the flow is fully composed.
+func (state *State) WithEventEquality(equality Equality) *State {
+	state.root().each(func(s *State) {
+		s.equality = equality
+	})
+	return state
+}
+
+// EventsEqual decides whether the given EventData represent the same event
+// using the Equality registered for the flow with WithEventEquality, or
+// using reflect.DeepEqual if there is none.
+func (state *State) EventsEqual(a, b EventData) bool {
+	if state.equality == nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return state.equality(a, b)
+}
+
 // Start starts a new flow from the root of the given State.
+//
+// Build also orders the outbound transitions of each State so that Tests with
+// a higher priority are evaluated first (see Prioritizer) and cheaper Tests
+// before more expensive ones (see Coster).  Since Advance takes the first
+// transition whose Test passes, this decides which transition is taken when
+// several Tests of a State pass the same event, which flows built with
+// BuildStrict rule out.  IDs are assigned before the transitions are
+// ordered, so they don't depend on priorities or costs.
 func (state *State) Build() *State {
+	return state.BuildWith(new(sequentialIDs))
+}
+
+// IDGenerator generates the IDs of the States of a flow as it is built with
+// BuildWith, for example to keep the IDs of several flows that share a store
+// from colliding.
+type IDGenerator interface {
+	// Next returns the ID of the next State.  IDs should be positive, since
+	// States that haven't been built have the ID 0.
+	Next() int
+}
+
+// sequentialIDs generates the IDs 1, 2, 3 ... that Build gives States.
+type sequentialIDs int
+
+func (ids *sequentialIDs) Next() int {
+	*ids++
+	return int(*ids)
+}
+
+// BuildWith builds the flow the same as Build, except that the IDs of its
+// States are generated by gen in the order in which Build would number them.
+// States are numbered depth first from the root, and States where branches
+// join are numbered again each time they are reached, keeping the last ID
+// generated for them, so gen may be asked for more IDs than there are
+// States.  CountEntries and DecodeFlow keep the generated IDs.
+func (state *State) BuildWith(gen IDGenerator) *State {
 	root := state.root()
-	root.assignIds(0)
+	root.assignIds(gen)
+	return root.finishBuild()
+}
+
+// finishBuild completes building the flow starting at the given root once
+// its IDs have been assigned, and returns the root.
+func (root *State) finishBuild() *State {
+	root.sortByCost()
+	// Remember the root, since a built flow is no longer composed in place
+	root.each(func(s *State) {
+		s.rootCache = root
+	})
 	return root
 }
 
+// BuildSafe builds the flow the same as Build, but first checks that the
+// flow is acyclic, as Build assumes without checking.  Operators never build
+// cycles, but a flow wired up by other means may contain one, on which Build
+// and FindByID would never return.  BuildSafe returns an error naming the
+// Tests along the cycle instead.
+func (state *State) BuildSafe() (*State, error) {
+	visited := make(map[*State]bool)
+	root := state
+	for len(root.in) > 0 {
+		if visited[root] {
+			return nil, fmt.Errorf("the flow has no root, since the transitions into it form a cycle")
+		}
+		visited[root] = true
+		root = root.in[0].from
+	}
+	if err := root.detectCycle(); err != nil {
+		return nil, err
+	}
+	return root.Build(), nil
+}
+
 func (state *State) Advance(data EventData) *State {
-	// Go through outbound transitions and see which pass the test
-	for _, tran := range state.out {
-		if tran.test(data) {
-			// Transition test passed, advance
-			if tran.to.action != nil {
-				// Execute the action
-				tran.to.action(data)
-			}
-			// Advance to the next State
-			return tran.to
+	next, _ := state.AdvanceE(data)
+	return next
+}
+
+// AdvanceE advances the same as Advance, and also reports whether the event
+// triggered a transition, sparing callers from comparing IDs to find out
+// whether the flow made progress.
+func (state *State) AdvanceE(data EventData) (*State, bool) {
+	return state.advance(data, nil)
+}
+
+// AdvanceAs advances the same as Advance on behalf of a caller holding the
+// given permissions, skipping any transitions that require a permission the
+// caller lacks.  Advance itself never takes transitions that require a
+// permission.
+func (state *State) AdvanceAs(data EventData, perms []string) *State {
+	next, _ := state.advance(data, perms)
+	return next
+}
+
+func (state *State) advance(data EventData, perms []string) (*State, bool) {
+	if state.validate(data) != nil {
+		return state, false
+	}
+	tran := state.step(data, perms)
+	if tran == nil {
+		return state, false
+	}
+	// Advance to the next State
+	tran.enter(data, nil)
+	return tran.to, true
+}
+
+// AdvanceResult describes the outcome of advancing a flow with AdvanceEx.
+type AdvanceResult struct {
+	// State is the State reached, which is the State advanced from if the
+	// event didn't trigger a transition.
+	State *State
+	// Advanced reports whether the event triggered a transition.
+	Advanced bool
+	// BlockedBy names the guard that kept the event from triggering a
+	// transition whose Test it passed, such as `permission "admin"`, or
+	// "guard" for a Guard that vetoed it (see THENIf), or is "" if the event
+	// advanced the flow or simply passed no Test.
+	BlockedBy string
+}
+
+// AdvanceEx advances the same as AdvanceAs, but describes the outcome in an
+// AdvanceResult, which tells events that passed no Test apart from events
+// that passed a Test but were blocked, for example by the permission
+// required by a transition built with THENAuth or the Guard of one built
+// with THENIf.  Events that fail validation (see WithValidator) are ignored
+// before being tested, so they are never reported as blocked.  Guards aren't
+// run again to find the one that blocked the event, since they may have
+// side effects.
+func (state *State) AdvanceEx(data EventData, perms []string) AdvanceResult {
+	if state.validate(data) != nil {
+		return AdvanceResult{State: state}
+	}
+	if tran := state.step(data, perms); tran != nil {
+		tran.enter(data, nil)
+		return AdvanceResult{State: tran.to, Advanced: true}
+	}
+	for _, trans := range state.moves() {
+		if !trans.passes(data) {
+			continue
+		}
+		if !trans.permitted(perms) {
+			return AdvanceResult{State: state, BlockedBy: fmt.Sprintf("permission %q", trans.perm)}
+		}
+		if trans.guard != nil {
+			// A permitted transition whose Test passed can only have been
+			// vetoed by its Guard
+			return AdvanceResult{State: state, BlockedBy: "guard"}
+		}
+	}
+	return AdvanceResult{State: state}
+}
+
+// AdvanceDeferred advances the same as Advance, except that rather than
+// executing the actions of the State being advanced into, it returns them
+// bound to the given EventData.  This leaves it to the caller to execute the
+// actions at a time of its choosing, for example within a transaction, or
+// not at all.
+func (state *State) AdvanceDeferred(data EventData) (*State, []func()) {
+	if state.validate(data) != nil {
+		return state, nil
+	}
+	tran := state.step(data, nil)
+	if tran == nil {
+		return state, nil
+	}
+	return tran.to, tran.bind(data, nil)
+}
+
+// AdvanceAny treats the given events as having arrived at the same time, any
+// one of which may advance the flow.  It tries the events in order and
+// advances on the first that triggers a transition, the same as Advance,
+// returning the resulting State, the event that advanced it and true.  The
+// remaining events are not tried, so at most one transition is taken.  If
+// none of the events trigger a transition, AdvanceAny returns the given
+// State, nil and false.
+func (state *State) AdvanceAny(events []EventData) (*State, EventData, bool) {
+	for _, data := range events {
+		if state.validate(data) != nil {
+			continue
+		}
+		if tran := state.step(data, nil); tran != nil {
+			tran.enter(data, nil)
+			return tran.to, data, true
 		}
 	}
+	return state, nil, false
+}
+
+// AdvanceAll advances from the given State through each of the given events
+// in order, the same as calling Advance in a loop, and returns the resulting
+// State along with the number of events that triggered a transition.  Once
+// the flow is finished, the remaining events are left unprocessed.
+func (state *State) AdvanceAll(events []EventData) (*State, int) {
+	advanced := 0
+	for _, data := range events {
+		if state.Finished() {
+			break
+		}
+		if state.validate(data) != nil {
+			continue
+		}
+		if tran := state.step(data, nil); tran != nil {
+			tran.enter(data, nil)
+			state = tran.to
+			advanced++
+		}
+	}
+	return state, advanced
+}
+
+// WarmStart advances from the root of the flow through the given prefix of
+// events and returns the resulting State.  Because States are immutable, the
+// result can be cached and reused as the starting point of any number of
+// runs that begin with the same prefix.  Actions along the prefix execute
+// only once, during WarmStart.
+func (root *State) WarmStart(prefix []EventData) *State {
+	state := root.root()
+	for _, data := range prefix {
+		state = state.Advance(data)
+	}
 	return state
 }
 
+// Reset returns the root of the flow containing the given State, from which
+// a run that failed part way can start over.  Reset doesn't build the flow,
+// so the root has its IDs assigned only if the flow was built beforehand.
+// The root of a flow that was never built can still be advanced, but its
+// States all have ID 0 until Build is called.
+func (state *State) Reset() *State {
+	return state.root()
+}
+
+// FindByID finds the State with the given ID among the given State and the
+// States reachable from it.  The States shared by several branches, such as
+// the ends of ORs and ANDs, are searched only once, however many branches
+// lead to them.
 func (state *State) FindByID(id int) *State {
-	if state.ID == id {
-		return state
-	}
-	for _, trans := range state.out {
-		result := trans.to.FindByID(id)
-		if result != nil {
-			return result
+	var visited map[*State]bool
+	pending := []*State{state}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		// Only States with several inbound transitions can be reached twice
+		if len(current.in) > 1 {
+			if visited[current] {
+				continue
+			}
+			if visited == nil {
+				visited = make(map[*State]bool)
+			}
+			visited[current] = true
+		}
+		if current.ID == id {
+			return current
+		}
+		// Push in reverse so that transitions are searched in order
+		for i := len(current.out) - 1; i >= 0; i-- {
+			pending = append(pending, current.out[i].to)
 		}
 	}
 	return nil
 }
 
-// Finished indicates whether or not the flow is finished.
+// TransitionFunc returns the advancing logic of the built flow containing the
+// given State as a function of State IDs, for embedding the flow in other
+// state machines that would rather not hold on to States.  Given the ID of a
+// State and an event, the function advances the same as Advance, returning
+// the ID of the resulting State and whether any actions fired.  Unknown IDs
+// are returned unchanged.  Since the positions inside a lazily evaluated AND
+// have no ID (see LAZYAND), such flows can't be driven this way.
+func (root *State) TransitionFunc() func(stateID int, data EventData) (nextID int, actionFired bool) {
+	index := make(map[int]*State)
+	root.root().each(func(s *State) {
+		index[s.ID] = s
+	})
+	return func(stateID int, data EventData) (int, bool) {
+		state := index[stateID]
+		if state == nil || state.validate(data) != nil {
+			return stateID, false
+		}
+		tran := state.step(data, nil)
+		if tran == nil {
+			return stateID, false
+		}
+		return tran.to.ID, tran.enter(data, nil)
+	}
+}
+
+// SubflowFrom extracts the part of the built flow containing the given State
+// that can be reached from the State with the given ID, returning the root
+// of an independent, built copy of it.  This allows the tail of a flow to be
+// exercised on its own, for example when testing its actions.  It returns
+// nil if the flow has no State with the given ID.
+func (root *State) SubflowFrom(id int) *State {
+	state := root.root().FindByID(id)
+	if state == nil {
+		return nil
+	}
+	return state.doCopy(make(map[*State]*State)).Build()
+}
+
+// Finished indicates whether or not the flow is finished, meaning that no
+// further event can advance it.  A State with epsilon transitions (see
+// EPSILON) is finished only if none of the States they lead to can be
+// advanced either.
 func (state *State) Finished() bool {
-	return len(state.out) == 0
+	if !state.hasEpsilon() {
+		return len(state.out) == 0
+	}
+	for _, s := range state.closure() {
+		for _, trans := range s.out {
+			if !trans.epsilon {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Completed indicates whether or not the flow finished at one of its intended
+// ends, which is a finished State with an action (see DO) or an outcome (see
+// Outcome).  Finished alone doesn't distinguish these from States at which a
+// flow is simply stuck with no transitions left.  A finished State is also
+// completed if one of the States that its epsilon transitions lead to is.
+func (state *State) Completed() bool {
+	if !state.Finished() {
+		return false
+	}
+	for _, s := range state.closure() {
+		if len(s.out) == 0 && (len(s.actions) > 0 || s.outcome != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsComplete indicates whether the flow finished at a State with an action
+// (see DO), as opposed to one at which it is stuck with no transitions left.
+// Unlike Completed, it doesn't count an outcome alone as completion.  For
+// flows built with OR or AND whose action was registered on the result, only
+// the common end is complete.
+func (state *State) IsComplete() bool {
+	if !state.Finished() {
+		return false
+	}
+	for _, s := range state.closure() {
+		if len(s.out) == 0 && len(s.actions) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAction indicates whether any action is registered for the given State
+// or the other States in its epsilon closure, which Advance fires on
+// entering the State (see DO).
+func (state *State) HasAction() bool {
+	for _, s := range state.closure() {
+		if len(s.actions) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Action returns an Action that fires the actions registered for the given
+// State the same as Advance does on entering it, in order and subject to
+// their conditions (see DOIf), or nil if it has none (see HasAction).  This
+// lets a client program resuming a run inspect or schedule the actions of
+// a State without advancing into it.
+func (state *State) Action() Action {
+	if !state.HasAction() {
+		return nil
+	}
+	return func(data EventData) {
+		state.enter(data, nil)
+	}
 }
 
 /* PRIVATE FUNCTIONS */
+// step finds the transition that the given EventData triggers from the given
+// State without executing any actions.  It returns nil if the EventData does
+// not trigger any transition.
+func (state *State) step(data EventData, perms []string) *transition {
+	for _, s := range state.closure() {
+		if s.lazy != nil {
+			if tran := s.stepLazy(data, perms); tran != nil {
+				return tran
+			}
+			continue
+		}
+		// Go through outbound transitions and see which pass the test
+		for _, tran := range s.out {
+			if !tran.epsilon && tran.permitted(perms) && tran.passes(data) && tran.guarded(data) {
+				return tran.completeTogether(data, perms)
+			}
+		}
+	}
+	for _, s := range state.closure() {
+		if s.until.isZero() {
+			continue
+		}
+		// Absorb the event by looping back to the same State
+		absorb := &transition{test: s.until, absorbs: true, from: state, to: state}
+		if absorb.passes(data) {
+			return absorb
+		}
+	}
+	return nil
+}
+
+// moves returns the transitions that can be taken from the given State.
+func (state *State) moves() []*transition {
+	if !state.hasEpsilon() {
+		if state.lazy != nil {
+			return state.movesLazy()
+		}
+		return state.out
+	}
+	var moves []*transition
+	for _, s := range state.closure() {
+		if s.lazy != nil {
+			moves = append(moves, s.movesLazy()...)
+			continue
+		}
+		for _, trans := range s.out {
+			if !trans.epsilon {
+				moves = append(moves, trans)
+			}
+		}
+	}
+	return moves
+}
+
+// validate checks the given EventData using the State's Validator, if any.
+func (state *State) validate(data EventData) error {
+	if state.validator == nil {
+		return nil
+	}
+	return state.validator(data)
+}
+
+// enter executes the actions registered for the given State and the other
+// States in its epsilon closure, which are being advanced into because of the
+// given EventData by a run with the given Vars, and reports whether any of
+// them fired.
+func (state *State) enter(data EventData, vars Vars) bool {
+	fired := false
+	for _, s := range state.closure() {
+		for i, action := range s.actions {
+			if s.conditions[i] == nil || s.conditions[i](vars) {
+				// Execute the action
+				s.bindState(i, action, state)(data)
+				fired = true
+			}
+		}
+	}
+	return fired
+}
+
+// bindState returns the action registered for the given State at the given
+// index, handing the reached State to it if it was registered with DOState.
+func (state *State) bindState(i int, action Action, reached *State) Action {
+	stateAction := state.stateActions[i]
+	if stateAction == nil {
+		return action
+	}
+	return func(data EventData) {
+		stateAction(reached, data)
+	}
+}
+
+// bind returns the actions registered for the given State and the other
+// States in its epsilon closure whose conditions hold for the given Vars as
+// functions that execute them with the given EventData.
+func (state *State) bind(data EventData, vars Vars) []func() {
+	var bound []func()
+	for _, s := range state.closure() {
+		for i, action := range s.actions {
+			if s.conditions[i] != nil && !s.conditions[i](vars) {
+				continue
+			}
+			action := s.bindState(i, action, state)
+			bound = append(bound, func() {
+				action(data)
+			})
+		}
+	}
+	return bound
+}
+
+// enter counts an entry into the State that the given transition leads to
+// (see CountEntries), fires the transition's OnEnter hooks and then enters
+// the State, reporting whether any action fired.  A transition absorbing an
+// event for UNTIL stays at its State rather than entering it again.
+func (tran *transition) enter(data EventData, vars Vars) bool {
+	if tran.absorbs {
+		return false
+	}
+	tran.to.countEntry()
+	for _, hook := range tran.onEnter {
+		hook(data)
+	}
+	return tran.to.enter(data, vars) || len(tran.onEnter) > 0
+}
+
+// bind binds the OnEnter hooks of the given transition and then the actions
+// of the State it leads to to the given EventData, in the order in which
+// enter would fire them.
+func (tran *transition) bind(data EventData, vars Vars) []func() {
+	if tran.absorbs {
+		return nil
+	}
+	tran.to.countEntry()
+	var bound []func()
+	for _, hook := range tran.onEnter {
+		hook := hook
+		bound = append(bound, func() {
+			hook(data)
+		})
+	}
+	return append(bound, tran.to.bind(data, vars)...)
+}
+
+// then provides the functionality for THEN and THENAuth, requiring the given
+// permission (if any) on the transitions leading into to.
+func (from *State) then(to stateSource, perm string, guard Guard) *State {
+	newFrom := from.copy()
+	toState := to.state().copy()
+	toRoot := toState.root()
+	for _, trans := range toRoot.out {
+		if perm != "" {
+			trans.perm = perm
+		}
+		if guard != nil {
+			trans.guard = guard
+		}
+	}
+	// The other ends of from continue into the same copy of to
+	for _, end := range newFrom.ends {
+		end.continueWith(toRoot, true)
+	}
+	newFrom.continueWith(toRoot, false)
+	newFrom.ends = nil
+	return toState
+}
+
+// continueWith continues the flow from the given State with the flow
+// starting at the given root, taking over the root's transitions, or
+// cloning them if clone is true.
+func (state *State) continueWith(toRoot *State, clone bool) {
+	for _, trans := range toRoot.out {
+		if clone {
+			trans = trans.clone(state, trans.to)
+			trans.to.addIn(trans)
+		}
+		state.addOut(trans)
+	}
+	if toRoot.lazy != nil {
+		state.lazy = toRoot.lazy
+		state.barrier = toRoot.barrier
+		state.fallback = toRoot.fallback
+	}
+	if state.kind == KindNormal {
+		state.kind = toRoot.kind
+	}
+	state.shadows = state.shadows || toRoot.shadows
+	if !toRoot.until.isZero() {
+		state.until = toRoot.until
+	}
+}
+
+// withEnds returns the given State followed by the other ends of the flow
+// that it stands for (see joinEnds).
+func (state *State) withEnds() []*State {
+	return append([]*State{state}, state.ends...)
+}
+
+// joinEnds returns the State that stands for the end of the flow starting
+// at the given start, whose branches finish either at the given common end
+// or at terminals of their own labeled with outcomes, and records the other
+// terminals as its ends, so that THEN and DO apply to all of them.
+func (start *State) joinEnds(end *State) *State {
+	result := end
+	if len(end.in) == 0 {
+		// Every branch finished in an outcome of its own, leaving the common
+		// end unused.  Return one of the outcome terminals instead so that
+		// the flow can still be reached from the result.
+		result = start.terminal()
+	}
+	visited := map[*State]bool{result: true}
+	pending := []*State{start}
+	for len(pending) > 0 {
+		s := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, trans := range s.out {
+			if !visited[trans.to] {
+				visited[trans.to] = true
+				pending = append(pending, trans.to)
+				if len(trans.to.out) == 0 && trans.to.lazy == nil {
+					result.ends = append(result.ends, trans.to)
+				}
+			}
+		}
+	}
+	return result
+}
+
 // state is provided to make State itself a StateSource.
 func (state *State) state() *State {
 	return state
@@ -389,6 +1330,7 @@ func (test Test) state() *State {
 func (state *State) addIn(trans *transition) {
 	trans.to = state
 	state.in = append(state.in, trans)
+	state.rootCache = nil
 }
 
 // addOut adds an outbound transition to the given state, updating the
@@ -398,65 +1340,240 @@ func (state *State) addOut(trans *transition) {
 	state.out = append(state.out, trans)
 }
 
-// hasTest checks whether any of the state's outbound transitions use the
-// specified test
-func (state *State) hasTest(test Test) bool {
-	return state.transitionWithTest(test) != nil
+// hasTransitionLike checks whether any of the state's outbound transitions
+// use the same test and permission as the specified transition
+func (state *State) hasTransitionLike(other *transition) bool {
+	return state.transitionLike(other) != nil
 }
 
-func (state *State) transitionWithTest(test Test) *transition {
+func (state *State) transitionLike(other *transition) *transition {
+	if other.epsilon || other.guard != nil {
+		// Epsilon transitions lead to different States, and the Guards of
+		// guarded transitions can't be compared, so never merge them
+		return nil
+	}
 	for _, trans := range state.out {
-		if trans.test == test {
+		if !trans.epsilon && trans.guard == nil && sameTest(trans.test, other.test) && trans.perm == other.perm {
 			return trans
 		}
 	}
 	return nil
 }
 
-// root finds the root state of the flow, starting from the given state.
+// clone creates a new transition from the given from State to the given to
+// State with the same test and permission as the given transition.
+func (trans *transition) clone(from *State, to *State) *transition {
+	return &transition{test: trans.test, perm: trans.perm, guard: trans.guard, transform: trans.transform, epsilon: trans.epsilon, source: trans.source, onEnter: append([]Action(nil), trans.onEnter...), andWidth: trans.andWidth, from: from, to: to}
+}
+
+// completeTogether returns the given transition, or, if it's inside an AND
+// configured using CompleteTogether and the given EventData would also
+// finish every remaining flow of the AND, a transition that skips straight
+// to the end of the AND.
+func (tran *transition) completeTogether(data EventData, perms []string) *transition {
+	end := tran.from.andGroup
+	if end == nil || !end.together {
+		return tran
+	}
+	current := tran.to
+	for current != end && current.andGroup == end {
+		next := current.step(data, perms)
+		if next == nil {
+			return tran
+		}
+		current = next.to
+	}
+	if current != end {
+		return tran
+	}
+	return tran.clone(tran.from, end)
+}
+
+// guarded checks whether the Guard of the given transition, if any, allows
+// it to be taken because of the given EventData, which has passed its Test.
+func (trans *transition) guarded(data EventData) bool {
+	if trans.guard == nil {
+		return true
+	}
+	if event, ok := data.(*contextEvent); ok {
+		data = event.data
+	}
+	return trans.guard(data)
+}
+
+// permitted checks whether a caller holding the given permissions may take
+// the transition.
+func (trans *transition) permitted(perms []string) bool {
+	if trans.perm == "" {
+		return true
+	}
+	for _, perm := range perms {
+		if perm == trans.perm {
+			return true
+		}
+	}
+	return false
+}
+
+// root finds the root state of the flow, starting from the given state.  The
+// root of a built flow is remembered by Build, for as long as nothing has
+// been added in front of it.
 func (state *State) root() *State {
-	if len(state.in) == 0 {
-		return state
+	if cached := state.rootCache; cached != nil && len(cached.in) == 0 {
+		return cached
+	}
+	for len(state.in) > 0 {
+		state = state.in[0].from
 	}
-	return state.in[0].from.root()
+	return state
 }
 
 // copy makes a deep copy of the given state.  The copy is deep because
 // all transitively referenced states (inbound and outbound) are copied also.
+// As with Fork, a position inside a lazily evaluated AND isn't reachable
+// from the root, so its copy starts a flow of its own.
 func (state *State) copy() *State {
 	stateCopies := make(map[*State]*State)
 
 	state.root().doCopy(stateCopies)
 
-	return stateCopies[state]
+	return state.doCopy(stateCopies)
 }
 
 func (state *State) PubCopy() *State {
 	return state.copy()
 }
 
+// Fork makes a deep copy of the flow containing the given State and returns
+// the copy of the given State, so that a run can continue independently
+// from the same position in both flows, for example to evaluate a
+// speculative continuation.  Unlike copies made by operators, the copies
+// keep the IDs of the States they copy, so FindByID finds the same
+// positions in the fork as in the original flow.  A position inside a
+// lazily evaluated AND is forked along with the flow, but the fork doesn't
+// remember the positions that led to it (see Reset).
+func (state *State) Fork() *State {
+	stateCopies := make(map[*State]*State)
+	state.root().doCopy(stateCopies)
+	fork := state.doCopy(stateCopies)
+	for original, stateCopy := range stateCopies {
+		stateCopy.ID = original.ID
+	}
+	return fork
+}
+
+// copyFrame tracks the progress of doCopy through the States referenced by
+// one of the States being copied.
+type copyFrame struct {
+	state    *State
+	children []*State
+	next     int
+}
+
+// doCopy copies the given State and every State it references, recording
+// the copies in stateCopies.  It uses an explicit stack rather than
+// recursion so that very long flows don't overflow the call stack, but
+// copies each State's references in the same order as a recursive copy
+// would, so that the inbound transitions of each copy keep their order.
 func (state *State) doCopy(stateCopies map[*State]*State) *State {
-	stateCopy := stateCopies[state]
-	if stateCopy != nil {
+	if stateCopy := stateCopies[state]; stateCopy != nil {
 		return stateCopy
 	}
 
-	stateCopy = new(State)
+	stack := []*copyFrame{state.startCopy(stateCopies)}
+	for len(stack) > 0 {
+		frame := stack[len(stack)-1]
+		if frame.next == len(frame.children) {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		child := frame.children[frame.next]
+		childCopy := stateCopies[child]
+		if childCopy == nil {
+			// Copy the child in full before linking to it
+			stack = append(stack, child.startCopy(stateCopies))
+			continue
+		}
+		frame.state.linkCopy(stateCopies[frame.state], frame.next, childCopy)
+		frame.next++
+	}
+	return stateCopies[state]
+}
+
+// startCopy creates the copy of the given State with its attributes but
+// without its references to other States, which doCopy adds by calling
+// linkCopy once for each of the returned frame's children.
+func (state *State) startCopy(stateCopies map[*State]*State) *copyFrame {
+	stateCopy := new(State)
 	stateCopies[state] = stateCopy
 
+	stateCopy.actions = append([]Action(nil), state.actions...)
+	stateCopy.conditions = append([]Condition(nil), state.conditions...)
+	stateCopy.contextActions = append([]ContextAction(nil), state.contextActions...)
+	stateCopy.stateActions = append([]StateAction(nil), state.stateActions...)
+	stateCopy.outcome = state.outcome
+	stateCopy.validator = state.validator
+	stateCopy.equality = state.equality
+	stateCopy.weight = state.weight
+	stateCopy.lazily = state.lazily
+	stateCopy.barrier = state.barrier
+	stateCopy.fallback = state.fallback
+	stateCopy.kind = state.kind
+	stateCopy.together = state.together
+	stateCopy.sla = state.sla
+	stateCopy.shadows = state.shadows
+	stateCopy.until = state.until
+
+	frame := &copyFrame{state: state}
 	for _, out := range state.out {
-		newTo := out.to.doCopy(stateCopies)
-		trans := &transition{test: out.test, from: stateCopy, to: newTo}
-		stateCopy.addOut(trans)
-		newTo.addIn(trans)
+		frame.children = append(frame.children, out.to)
 	}
+	frame.children = append(frame.children, state.andedStates...)
+	frame.children = append(frame.children, state.lazy...)
+	frame.children = append(frame.children, state.ends...)
+	if state.andGroup != nil {
+		frame.children = append(frame.children, state.andGroup)
+	}
+	return frame
+}
 
-	for _, andedState := range state.andedStates {
-		stateCopy.andedStates = append(stateCopy.andedStates, andedState.doCopy(stateCopies))
+// linkCopy adds the reference with the given index (see startCopy) to the
+// copy of the given State, pointing it at the given copy of the referenced
+// State.
+func (state *State) linkCopy(stateCopy *State, index int, childCopy *State) {
+	switch {
+	case index < len(state.out):
+		trans := state.out[index].clone(stateCopy, childCopy)
+		stateCopy.addOut(trans)
+		childCopy.addIn(trans)
+	case index < len(state.out)+len(state.andedStates):
+		stateCopy.andedStates = append(stateCopy.andedStates, childCopy)
+	case index < len(state.out)+len(state.andedStates)+len(state.lazy):
+		stateCopy.lazy = append(stateCopy.lazy, childCopy)
+	case index < len(state.out)+len(state.andedStates)+len(state.lazy)+len(state.ends):
+		stateCopy.ends = append(stateCopy.ends, childCopy)
+	default:
+		stateCopy.andGroup = childCopy
 	}
+}
 
-	stateCopy.action = state.action
-	return stateCopy
+// each calls visit once for every State reachable from the given State,
+// including the State itself.
+func (state *State) each(visit func(state *State)) {
+	visited := make(map[*State]bool)
+	pending := []*State{state}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		visit(current)
+		for i := len(current.out) - 1; i >= 0; i-- {
+			pending = append(pending, current.out[i].to)
+		}
+	}
 }
 
 func (state *State) countChildren() int {
@@ -468,60 +1585,104 @@ func (state *State) countChildren() int {
 }
 
 // addOrStates provides the functionality for recursively building a tree of
-// states that model an OR condition.
-func (state *State) addOrStates(left *State, right *State, end *State) {
+// states that model an OR condition.  If preferLeft is true, the left branch
+// wins when one branch finishes on a test where the other continues.
+func (state *State) addOrStates(left *State, right *State, end *State, joined map[*State]*State, preferLeft bool) {
+	state.shadows = state.shadows || left.shadows || right.shadows
 	for _, trans := range left.out {
 		atEnd := len(trans.to.out) == 0
+		terminal := trans.to
 		var next *State
 		var nextLeft = trans.to
 		var nextRight = right
 
-		if right.hasTest(trans.test) {
+		if right.hasTransitionLike(trans) {
 			// The right branch has a transition with this same test.
 			// Merge them by creating a new template state that combines
 			// the outbound transitions from both left and right.
-			rightTrans := right.transitionWithTest(trans.test)
-			if len(rightTrans.to.out) == 0 {
+			rightTrans := right.transitionLike(trans)
+			rightAtEnd := len(rightTrans.to.out) == 0
+			if atEnd != rightAtEnd {
+				// Only one of the branches can win, shadowing the other
+				state.shadows = true
+			}
+			switch {
+			case preferLeft && !atEnd && rightAtEnd:
+				// The left branch continues in preference to the right one
+				nextRight = new(State)
+			case rightAtEnd:
+				if !atEnd {
+					terminal = rightTrans.to
+				}
 				atEnd = true
-			} else {
+			default:
 				nextRight = rightTrans.to
 			}
 		}
 
 		if atEnd {
-			next = end
+			next = terminal.joinedEnd(end, joined)
 		} else {
 			next = new(State)
 		}
 
-		newTrans := &transition{test: trans.test, from: state, to: next}
+		newTrans := trans.clone(state, next)
+		if rightTrans := right.transitionLike(trans); rightTrans != nil {
+			// The merged transition enters both branches, so it fires the
+			// OnEnter hooks of both
+			newTrans.onEnter = append(newTrans.onEnter, rightTrans.onEnter...)
+		}
 		state.addOut(newTrans)
 		next.addIn(newTrans)
 		if !atEnd {
-			next.addOrStates(nextLeft, nextRight, end)
+			next.addOrStates(nextLeft, nextRight, end, joined, preferLeft)
 		}
 	}
 	for _, trans := range right.out {
-		if left.hasTest(trans.test) {
+		if left.hasTransitionLike(trans) {
 			// This would have already been handled in the left branch.  Skip it.
 			continue
 		}
 		atEnd := len(trans.to.out) == 0
 		var next *State
 		if atEnd {
-			next = end
+			next = trans.to.joinedEnd(end, joined)
 		} else {
 			next = new(State)
 		}
-		newTrans := &transition{test: trans.test, from: state, to: next}
+		newTrans := trans.clone(state, next)
 		state.addOut(newTrans)
 		next.addIn(newTrans)
 		if !atEnd {
-			next.addOrStates(left, trans.to, end)
+			next.addOrStates(left, trans.to, end, joined, preferLeft)
 		}
 	}
 }
 
+// joinedEnd returns the State at which a branch ending in the given terminal
+// State finishes once joined into a larger flow with the given common end.
+// Terminals labeled with an outcome get a terminal of their own, which is
+// recorded in joined so that every path reaching the same terminal shares
+// it, all others share the common end.
+func (terminal *State) joinedEnd(end *State, joined map[*State]*State) *State {
+	if terminal.outcome == "" {
+		return end
+	}
+	if joined[terminal] == nil {
+		joined[terminal] = &State{outcome: terminal.outcome, kind: KindOREnd}
+	}
+	return joined[terminal]
+}
+
+// terminal follows the first outbound transition of each State until it
+// reaches a State with no outbound transitions.
+func (state *State) terminal() *State {
+	for len(state.out) > 0 {
+		state = state.out[0].to
+	}
+	return state
+}
+
 // addAndStates provides the functionality for recursively building a tree of
 // states that model an AND condition.
 func (state *State) addAndStates(andedStates []*State, end *State) {
@@ -534,7 +1695,13 @@ func (state *State) addAndStates(andedStates []*State, end *State) {
 		for _, trans := range andedState.out {
 			atEnd = false
 			next := new(State)
-			newTrans := &transition{test: trans.test, from: state, to: next}
+			next.andGroup = end
+			newTrans := trans.clone(state, next)
+			if len(andedStates) > newTrans.andWidth {
+				// Remember the width of the widest AND the transition is
+				// part of, since OR rebuilds the States but not transitions
+				newTrans.andWidth = len(andedStates)
+			}
 			state.addOut(newTrans)
 			next.addIn(newTrans)
 			var nextAndedStates []*State
@@ -550,13 +1717,17 @@ func (state *State) addAndStates(andedStates []*State, end *State) {
 	}
 }
 
-func (state *State) assignIds(startingId int) int {
-	currentId := startingId + 1
-	state.ID = currentId
-	for _, trans := range state.out {
-		currentId = trans.to.assignIds(currentId)
+func (state *State) assignIds(gen IDGenerator) {
+	pending := []*State{state}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		current.ID = gen.Next()
+		// Push in reverse so that transitions are numbered in order
+		for i := len(current.out) - 1; i >= 0; i-- {
+			pending = append(pending, current.out[i].to)
+		}
 	}
-	return currentId
 }
 
 // replace replaces the state at the given position in the given state slice
@@ -1,15 +1,16 @@
 package gflow
 
 import (
+	"context"
 	"fmt"
 	"testing"
 )
 
 func makeTest(val string) Test {
-	return func(data EventData) bool {
+	return NewTest(func(data EventData) bool {
 		fmt.Println(val+"?", data)
 		return data.(string) == val
-	}
+	})
 }
 
 var a Test = makeTest(A)
@@ -141,3 +142,969 @@ func TestIT(t *testing.T) {
 		doTest(test)
 	}
 }
+
+func TestOutcome(t *testing.T) {
+	flow := a.Outcome("approved").OR(b.Outcome("rejected")).OR(c.Outcome("escalated")).Build()
+
+	outcomes := map[string]string{A: "approved", B: "rejected", C: "escalated"}
+	for event, expected := range outcomes {
+		state := flow.Advance(event)
+		if !state.Finished() {
+			t.Errorf("%s did not finish the flow", event)
+		}
+		if outcome, ok := state.OutcomeName(); !ok || outcome != expected {
+			t.Errorf("%s finished with outcome %q, expected %q", event, outcome, expected)
+		}
+	}
+
+	if _, ok := flow.OutcomeName(); ok {
+		t.Errorf("root of flow should not have an outcome")
+	}
+}
+
+func TestOutcomeTHEN(t *testing.T) {
+	flow := a.Outcome("x").OR(b.Outcome("y")).THEN(c).Build()
+	if flow.Advance(A).Finished() || flow.Advance(B).Finished() || !finishes(flow, []string{A, C}) || !finishes(flow, []string{B, C}) {
+		t.Errorf("expected THEN to continue from every outcome")
+	}
+	mixed := a.Outcome("x").OR(b).THEN(c).Build()
+	if mixed.Advance(A).Finished() || mixed.Advance(B).Finished() || !finishes(mixed, []string{A, C}) || !finishes(mixed, []string{B, C}) {
+		t.Errorf("expected THEN to continue from outcomes and the common end alike")
+	}
+}
+
+func TestOutcomeDO(t *testing.T) {
+	var fired []EventData
+	flow := a.Outcome("x").OR(b.Outcome("y")).OR(c).DO(func(data EventData) {
+		fired = append(fired, data)
+	}).Build()
+	for _, event := range []string{A, B, C} {
+		flow.Advance(event)
+	}
+	if len(fired) != 3 {
+		t.Errorf("expected action to fire at every end, fired for %v", fired)
+	}
+	if outcome, _ := flow.Advance(B).OutcomeName(); outcome != "y" {
+		t.Errorf("expected outcome to survive DO, got %q", outcome)
+	}
+}
+
+func TestTHENAuth(t *testing.T) {
+	flow := a.THENAuth(b, "approve").OR(c).Build()
+
+	state := flow.Advance(A).Advance(B)
+	if state.Finished() {
+		t.Errorf("Advance took a transition requiring a permission")
+	}
+	state = state.AdvanceAs(B, []string{"review"})
+	if state.Finished() {
+		t.Errorf("AdvanceAs took a transition without holding its permission")
+	}
+	state = state.AdvanceAs(B, []string{"review", "approve"})
+	if !state.Finished() {
+		t.Errorf("AdvanceAs did not take a transition despite holding its permission")
+	}
+
+	if !flow.AdvanceAs(C, nil).Finished() {
+		t.Errorf("AdvanceAs did not take a transition requiring no permission")
+	}
+}
+
+func TestAdvanceEx(t *testing.T) {
+	flow := a.THENAuth(b, "approve").OR(c).Build()
+	state := flow.Advance(A)
+
+	if result := state.AdvanceEx(B, []string{"review"}); result.Advanced || result.State != state || result.BlockedBy != `permission "approve"` {
+		t.Errorf("expected B to be blocked by permission, got %+v", result)
+	}
+	if result := state.AdvanceEx(D, nil); result.Advanced || result.State != state || result.BlockedBy != "" {
+		t.Errorf("expected D to pass no test without being blocked, got %+v", result)
+	}
+	if result := state.AdvanceEx(B, []string{"approve"}); !result.Advanced || !result.State.Finished() || result.BlockedBy != "" {
+		t.Errorf("expected B to advance with permission, got %+v", result)
+	}
+	if result := state.AdvanceEx(C, nil); !result.Advanced || !result.State.Finished() {
+		t.Errorf("expected C to advance without permission, got %+v", result)
+	}
+
+	checks := 0
+	guarded := a.THENIf(func(data EventData) bool {
+		checks++
+		return false
+	}, b).Build().Advance(A)
+	if result := guarded.AdvanceEx(B, nil); result.Advanced || result.BlockedBy != "guard" || checks != 1 {
+		t.Errorf("expected B to be blocked by the guard, checked once, got %+v after %d checks", result, checks)
+	}
+}
+
+func TestWarmStart(t *testing.T) {
+	flow := a.THEN(b).THEN(c.AND(d)).Build()
+	warm := flow.WarmStart([]EventData{F, A, B})
+
+	for _, steps := range [][]string{{C, D}, {D, C}, {D, F}} {
+		fromWarm, fromRoot := warm, flow.Advance(A).Advance(B)
+		for _, step := range steps {
+			fromWarm, fromRoot = fromWarm.Advance(step), fromRoot.Advance(step)
+		}
+		if fromWarm.ID != fromRoot.ID {
+			t.Errorf("warm started run ended at state %d rather than %d", fromWarm.ID, fromRoot.ID)
+		}
+	}
+}
+
+func TestWithValidator(t *testing.T) {
+	validator := func(data EventData) error {
+		if _, ok := data.(string); !ok {
+			return fmt.Errorf("expected string event, got %T", data)
+		}
+		return nil
+	}
+	flow := a.THEN(b).WithValidator(validator).Build()
+
+	state := flow.Advance(1)
+	if state != flow {
+		t.Errorf("invalid event advanced the flow")
+	}
+	if !state.Advance(A).Advance(2).Advance(B).Finished() {
+		t.Errorf("valid events did not advance the flow")
+	}
+
+	run := flow.Run()
+	if _, err := run.Advance(1); err == nil {
+		t.Errorf("expected Runner to report invalid event")
+	}
+	if state, err := run.Advance(A); err != nil || state == flow {
+		t.Errorf("expected Runner to advance on valid event")
+	}
+}
+
+func TestWithEventEquality(t *testing.T) {
+	first := map[string]interface{}{"id": 1, "amount": 10}
+	retried := map[string]interface{}{"id": 1, "amount": 12}
+
+	flow := a.THEN(b).Build()
+	if flow.EventsEqual(first, retried) || !flow.EventsEqual(first, map[string]interface{}{"id": 1, "amount": 10}) {
+		t.Errorf("expected events to be compared with reflect.DeepEqual by default")
+	}
+
+	byID := func(x, y EventData) bool {
+		return x.(map[string]interface{})["id"] == y.(map[string]interface{})["id"]
+	}
+	flow = a.THEN(b).WithEventEquality(byID).Build()
+	if !flow.EventsEqual(first, retried) || !flow.Advance(A).EventsEqual(first, retried) {
+		t.Errorf("expected events with the same id to be equal throughout the flow")
+	}
+	if flow.EventsEqual(first, map[string]interface{}{"id": 2, "amount": 10}) {
+		t.Errorf("expected events with different ids to differ")
+	}
+}
+
+func TestCompleted(t *testing.T) {
+	flow, err := FromText("1 -a-> 2; 1 -b-> 3; 1 -c-> 4", map[string]Test{"a": a, "b": b, "c": c})
+	if err != nil {
+		t.Fatalf("unable to parse flow: %s", err)
+	}
+	flow.FindByID(3).DO(func(data EventData) {})
+	flow.FindByID(4).Outcome("escalated")
+
+	if flow.Completed() {
+		t.Errorf("unfinished flow reported as completed")
+	}
+	if stuck := flow.Advance(A); !stuck.Finished() || stuck.Completed() {
+		t.Errorf("expected dead end to be finished but not completed")
+	}
+	if !flow.Advance(B).Completed() {
+		t.Errorf("expected end with action to be completed")
+	}
+	if !flow.Advance(C).Completed() {
+		t.Errorf("expected end with outcome to be completed")
+	}
+}
+
+func TestIsComplete(t *testing.T) {
+	done := func(data EventData) {}
+	flow := a.THEN(b).OR(c.AND(d)).DO(done).Build()
+	for _, events := range [][]string{{A, B}, {C, D}, {D, C}} {
+		state := flow
+		for i, event := range events {
+			if state.Finished() || state.IsComplete() {
+				t.Errorf("expected %v to be incomplete after %d events", events, i)
+			}
+			state = state.Advance(event)
+		}
+		if !state.Finished() || !state.IsComplete() {
+			t.Errorf("expected %v to complete the flow at its common end", events)
+		}
+	}
+
+	stuck := a.THEN(b).Outcome("stuck").Build().Advance(A).Advance(B)
+	if !stuck.Finished() || stuck.IsComplete() || !stuck.Completed() {
+		t.Errorf("expected a finished State with only an outcome not to be complete")
+	}
+	if leaf := a.state().Build().Advance(A); !leaf.Finished() || leaf.IsComplete() {
+		t.Errorf("expected a finished State without an action not to be complete")
+	}
+}
+
+func TestAction(t *testing.T) {
+	var fired []EventData
+	flow := a.THEN(b).DO(func(data EventData) {
+		fired = append(fired, data)
+	}).Build()
+	end := flow.FindByID(flow.Advance(A).Advance(B).ID)
+	fired = nil
+
+	if flow.HasAction() || flow.Action() != nil || flow.Advance(A).HasAction() {
+		t.Errorf("expected only the end of the flow to have an action")
+	}
+	if !end.HasAction() || end.Action() == nil {
+		t.Fatalf("expected the end of the flow to have an action")
+	}
+	end.Action()(B)
+	if len(fired) != 1 || fired[0] != B {
+		t.Errorf("expected the action to fire with the given event, got %v", fired)
+	}
+	flow.Advance(A).Advance(B)
+	if len(fired) != 2 {
+		t.Errorf("expected Advance to fire the same action")
+	}
+}
+
+func TestMultipleActions(t *testing.T) {
+	var fired []string
+	flow := a.THEN(b).DO(func(data EventData) {
+		fired = append(fired, "log")
+	}).DO(func(data EventData) {
+		fired = append(fired, "business")
+	}).THEN(c).Build()
+
+	flow.Advance(A).Advance(B).Advance(C)
+	if len(fired) != 2 || fired[0] != "log" || fired[1] != "business" {
+		t.Errorf("expected both actions to fire in order after THEN, got %v", fired)
+	}
+}
+
+func TestWeight(t *testing.T) {
+	if !finishes(a.OR(a.THEN(c)), []string{A}) {
+		t.Errorf("expected finishing branch to win by default")
+	}
+	if !finishes(a.Weight(1).OR(a.THEN(c)), []string{A}) {
+		t.Errorf("expected heavier finishing branch to win")
+	}
+
+	weighted := a.OR(a.THEN(c).Weight(1))
+	if finishes(weighted, []string{A}) {
+		t.Errorf("expected heavier continuing branch to win")
+	}
+	if !finishes(weighted, []string{A, C}) {
+		t.Errorf("expected heavier continuing branch to finish")
+	}
+	if !finishes(a.THEN(c).Weight(1).OR(a), []string{A, C}) {
+		t.Errorf("expected weight to win regardless of operand order")
+	}
+}
+
+func TestDeepChain(t *testing.T) {
+	const length = 200000
+	step := Equals(A)
+	chain := new(State)
+	end := chain
+	for i := 0; i < length; i++ {
+		next := new(State)
+		trans := &transition{test: step, from: end, to: next}
+		end.addOut(trans)
+		next.addIn(trans)
+		end = next
+	}
+
+	flow := end.THEN(b).Build()
+	last := flow.FindByID(length + 1)
+	if last == nil || last.FindByID(length+2) == nil {
+		t.Fatalf("unable to find the end of a deep chain")
+	}
+	state := flow
+	for i := 0; i < length; i++ {
+		state = state.Advance(A)
+	}
+	if state != last || !state.Advance(B).Finished() {
+		t.Errorf("unable to advance through a deep chain")
+	}
+}
+
+func TestAdvanceDeferred(t *testing.T) {
+	var fired []string
+	record := func(label string) Action {
+		return func(data EventData) {
+			fired = append(fired, label+":"+data.(string))
+		}
+	}
+	flow := a.THEN(b).DO(record("log")).DO(record("business")).Build()
+
+	state, deferred := flow.AdvanceDeferred(A)
+	if state == flow || len(deferred) != 0 {
+		t.Errorf("expected to advance without actions, got %d", len(deferred))
+	}
+	state, deferred = state.AdvanceDeferred(B)
+	if !state.Finished() || len(deferred) != 2 || len(fired) != 0 {
+		t.Fatalf("expected to finish with two deferred actions and none fired")
+	}
+	for _, action := range deferred {
+		action()
+	}
+	deferredFired := fired
+
+	fired = nil
+	flow.Advance(A).Advance(B)
+	if len(fired) != len(deferredFired) || fired[0] != deferredFired[0] || fired[1] != deferredFired[1] {
+		t.Errorf("deferred actions fired %v rather than %v", deferredFired, fired)
+	}
+
+	if same, deferred := state.AdvanceDeferred(C); same != state || deferred != nil {
+		t.Errorf("expected no actions when not advancing")
+	}
+}
+
+func TestREPEAT(t *testing.T) {
+	if !finishes(a.REPEAT(3), []string{A, B, A, A}) || finishes(a.REPEAT(3), []string{A, A}) {
+		t.Errorf("expected a.REPEAT(3) to finish after three As")
+	}
+	if !a.REPEAT(0).Build().Finished() {
+		t.Errorf("expected a.REPEAT(0) to be finished")
+	}
+	if a.REPEAT(1).Canonical() != a.state().Canonical() {
+		t.Errorf("expected a.REPEAT(1) to be the same as a, got\n%s", a.REPEAT(1).Canonical())
+	}
+
+	var fired int
+	step := a.THEN(b).DO(func(data EventData) {
+		fired++
+	})
+	flow := step.REPEAT(2).Build()
+	if flow.FindByID(5) == nil || flow.FindByID(6) != nil {
+		t.Errorf("expected IDs 1 through 5 to be assigned to the repeated chain")
+	}
+	if !finishes(flow, []string{A, B, A, B}) || fired != 2 {
+		t.Errorf("expected actions to fire once per copy, fired %d times", fired)
+	}
+	step.DO(func(data EventData) {
+		fired += 10
+	})
+	fired = 0
+	finishes(flow, []string{A, B, A, B})
+	if fired != 2 {
+		t.Errorf("expected repeated flow not to share states with the flow it repeats, fired %d", fired)
+	}
+}
+
+func TestTIMES(t *testing.T) {
+	if !finishes(a.TIMES(3), []string{A, "X", A, "Y", A}) {
+		t.Errorf("expected a.TIMES(3) to finish on A -> X -> A -> Y -> A")
+	}
+	if finishes(a.TIMES(3), []string{A, "X", A, "Y"}) {
+		t.Errorf("expected a.TIMES(3) to wait for a third A")
+	}
+	flow := a.TIMES(3).Build()
+	if points := flow.DoubleCountPoints(); len(points) != 2 {
+		t.Errorf("expected each A to be counted once, got %v", points)
+	}
+	if !a.TIMES(0).Build().Finished() || !finishes(b.THEN(a.TIMES(2)), []string{B, A, A}) {
+		t.Errorf("expected a.TIMES(0) to be finished and TIMES to compose")
+	}
+}
+
+func TestTHENIf(t *testing.T) {
+	open := false
+	var checked []EventData
+	guard := func(data EventData) bool {
+		checked = append(checked, data)
+		return open
+	}
+	flow := a.THENIf(guard, b).THEN(c).Build()
+	state := flow.Advance(A)
+
+	if state.Advance(C) != state || len(checked) != 0 {
+		t.Errorf("expected guard to run only once the test has passed, ran on %v", checked)
+	}
+	if state.Advance(B) != state || len(checked) != 1 {
+		t.Errorf("expected guard to veto the transition")
+	}
+	open = true
+	if !state.Advance(B).Advance(C).Finished() {
+		t.Errorf("expected transition to be taken once the guard allows it")
+	}
+
+	copied := a.THENIf(guard, b).OR(d)
+	open = false
+	if copied.Build().Advance(A).Advance(B).Finished() {
+		t.Errorf("expected guard to survive copying")
+	}
+	if merged := a.THENIf(guard, b).OR(a.THEN(b)).Build(); len(merged.Advance(A).out) != 2 {
+		t.Errorf("expected guarded and unguarded transitions not to be merged")
+	}
+	if same := a.THENIf(guard, b).OR(a.THENIf(guard, b)).Build(); len(same.Advance(A).out) != 2 {
+		t.Errorf("expected transitions with a guard never to be merged")
+	}
+
+	checked = nil
+	adapted := Adapt(a.THENIf(guard, b), func(data EventData) EventData {
+		return data.(order).Shipment.Status
+	}).Build()
+	event := order{Shipment: shipment{A}}
+	if adapted.Advance(event).Advance(order{Shipment: shipment{B}}).Finished() || len(checked) != 1 || checked[0] != B {
+		t.Errorf("expected adapted guard to see the projected event, got %v", checked)
+	}
+}
+
+func TestUNTIL(t *testing.T) {
+	if !finishes(a.UNTIL(b), []string{A, A, B}) || !finishes(a.UNTIL(b), []string{B}) {
+		t.Errorf("expected a.UNTIL(b) to finish on B after any number of As")
+	}
+	if finishes(a.UNTIL(b.THEN(c)), []string{A, B, A}) || !finishes(a.UNTIL(b.THEN(c)), []string{A, B, A, C}) {
+		t.Errorf("expected a.UNTIL(b.THEN(c)) to finish once b.THEN(c) does")
+	}
+
+	var fired int
+	flow := c.THEN(a.UNTIL(b)).Build()
+	waiting := flow.Advance(C)
+	state, advanced := waiting.AdvanceE(A)
+	if !advanced || state != waiting {
+		t.Errorf("expected A to be absorbed, looping back to the waiting State")
+	}
+	if state, advanced := waiting.AdvanceE(D); advanced || state != waiting {
+		t.Errorf("expected unrelated event to be ignored")
+	}
+	if flow.Advance(A) != flow {
+		t.Errorf("expected A to be ignored before the UNTIL starts")
+	}
+	if !state.Advance(A).Advance(B).Finished() {
+		t.Errorf("expected B to finish the flow after absorbed As")
+	}
+
+	entered := 0
+	reached := c.state().DO(func(data EventData) {
+		entered++
+	}).THEN(a.UNTIL(b)).Build()
+	waiting = reached.Advance(C)
+	if state, advanced := waiting.AdvanceE(A); !advanced || state != waiting || entered != 1 {
+		t.Errorf("expected absorbed event not to fire the actions of the waiting State again, fired %d times", entered)
+	}
+
+	either := NamedTest("either", NewTest(func(data EventData) bool {
+		return data == A || data == B
+	}))
+	counted := either.UNTIL(b).DO(func(data EventData) {
+		fired++
+	}).Build()
+	if !counted.Advance(B).Finished() || fired != 1 {
+		t.Errorf("expected an event passing both Tests to advance other")
+	}
+
+	status := func(status string) order {
+		return order{Shipment: shipment{status}}
+	}
+	adapted := Adapt(a.UNTIL(b), func(data EventData) EventData {
+		return data.(order).Shipment.Status
+	}).Build()
+	if state, advanced := adapted.AdvanceE(status(A)); !advanced || state != adapted || !adapted.Advance(status(B)).Finished() {
+		t.Errorf("expected adapted UNTIL to absorb projected events")
+	}
+	replaced := a.UNTIL(b).ReplaceTest(a, c).Build()
+	if _, advanced := replaced.AdvanceE(A); advanced || !finishes(replaced, []string{C, B}) {
+		t.Errorf("expected the Test waited on to be replaced")
+	}
+	if alphabet := c.THEN(a.UNTIL(b)).Alphabet(); len(alphabet) != 3 || !containsTest(alphabet, a) {
+		t.Errorf("expected alphabet to include the Test waited on, got %d tests", len(alphabet))
+	}
+	if Equal(a.UNTIL(b).Build(), c.UNTIL(b).Build()) || Equal(a.UNTIL(b).Build(), b.state().Build()) {
+		t.Errorf("expected flows waiting on different Tests to differ")
+	}
+}
+
+func TestOnEnter(t *testing.T) {
+	var fired []string
+	record := func(label string) Action {
+		return func(data EventData) {
+			fired = append(fired, label+":"+data.(string))
+		}
+	}
+
+	flow := a.OnEnter(record("enter")).THEN(b).OR(c.THEN(d)).Build()
+	flow.Advance(A).Advance(B)
+	flow.Advance(C).Advance(A)
+	if len(fired) != 2 || fired[0] != "enter:A" || fired[1] != "enter:A" {
+		t.Errorf("expected hook to fire on entering intermediate state through OR, got %v", fired)
+	}
+
+	fired = nil
+	merged := a.THEN(b).OR(a.OnEnter(record("right"))).Build()
+	merged.Advance(A)
+	if len(fired) != 1 || fired[0] != "right:A" {
+		t.Errorf("expected hook of the right branch to survive merging with the left, got %v", fired)
+	}
+
+	fired = nil
+	anded := a.THEN(b).OnEnter(record("enter")).AND(c).DO(record("action")).Build()
+	state, deferred := anded.Advance(C).Advance(A).AdvanceDeferred(B)
+	if len(fired) != 0 || len(deferred) != 2 || !state.Finished() {
+		t.Fatalf("expected two deferred actions at the end of AND, got %d", len(deferred))
+	}
+	for _, action := range deferred {
+		action()
+	}
+	if len(fired) != 2 || fired[0] != "enter:B" || fired[1] != "action:B" {
+		t.Errorf("expected hook to fire before action, got %v", fired)
+	}
+
+	fired = nil
+	runner := flow.Run().Record("s", nil)
+	runner.Advance(A)
+	if log := runner.Log(); len(fired) != 1 || len(log) != 1 || !log[0].ActionFired {
+		t.Errorf("expected Runner to fire hook and log it as an action")
+	}
+}
+
+func TestDOState(t *testing.T) {
+	var reached []int
+	record := func(state *State, data EventData) {
+		reached = append(reached, state.ID)
+	}
+
+	registered := b.state().DOState(record).DO(func(data EventData) {
+		reached = append(reached, -1)
+	})
+	flow := a.THEN(registered).Build()
+	end := flow.Advance(A).Advance(B)
+	if end == registered || len(reached) != 2 || reached[0] != end.ID || reached[1] != -1 {
+		t.Errorf("expected action to see terminal state %d before plain action, got %v", end.ID, reached)
+	}
+
+	reached = nil
+	state, deferred := flow.Advance(A).AdvanceDeferred(B)
+	for _, action := range deferred {
+		action()
+	}
+	if len(reached) != 2 || reached[0] != state.ID {
+		t.Errorf("expected deferred action to see terminal state %d, got %v", state.ID, reached)
+	}
+
+	reached = nil
+	state, err := flow.Advance(A).AdvanceContext(context.Background(), B)
+	if err != nil || len(reached) != 2 || reached[0] != state.ID {
+		t.Errorf("expected context action to see terminal state %d, got %v", state.ID, reached)
+	}
+}
+
+func TestAdvanceAll(t *testing.T) {
+	var fired int
+	flow := a.THEN(b).DO(func(data EventData) {
+		fired++
+	}).Build()
+
+	state, advanced := flow.AdvanceAll([]EventData{C, A, C, B, A, B})
+	if !state.Finished() || advanced != 2 || fired != 1 {
+		t.Errorf("expected two events to finish the flow, advanced %d times and fired %d times", advanced, fired)
+	}
+	if state != flow.Advance(A).Advance(B) {
+		t.Errorf("expected AdvanceAll to end where a loop over Advance does")
+	}
+	if state, advanced := flow.AdvanceAll([]EventData{A, C}); state != flow.Advance(A) || advanced != 1 {
+		t.Errorf("expected to stop part way, advanced %d times", advanced)
+	}
+	if state, advanced := flow.AdvanceAll(nil); state != flow || advanced != 0 {
+		t.Errorf("expected no events to leave the flow where it was")
+	}
+}
+
+func TestAdvanceE(t *testing.T) {
+	var fired int
+	flow := a.THEN(b).DO(func(data EventData) {
+		fired++
+	}).Build()
+
+	state, advanced := flow.AdvanceE(C)
+	if advanced || state != flow {
+		t.Errorf("expected ignored event not to advance the flow")
+	}
+	state, advanced = state.AdvanceE(A)
+	if !advanced || state != flow.Advance(A) {
+		t.Errorf("expected A to advance the flow")
+	}
+	state, advanced = state.AdvanceE(B)
+	if !advanced || !state.Finished() || fired != 1 {
+		t.Errorf("expected B to finish the flow and fire its action once, fired %d times", fired)
+	}
+	if same, advanced := state.AdvanceE(B); advanced || same != state {
+		t.Errorf("expected finished flow not to advance")
+	}
+}
+
+func TestReset(t *testing.T) {
+	flow := a.THEN(b).THEN(c).Build()
+	state := flow.Advance(A).Advance(B)
+	if state.Reset() != flow || flow.Reset() != flow {
+		t.Errorf("expected Reset to return the root of the flow")
+	}
+	if !state.Reset().Advance(A).Advance(B).Advance(C).Finished() {
+		t.Errorf("expected run to start over from the root")
+	}
+
+	unbuilt := a.THEN(b)
+	root := unbuilt.Reset()
+	if root.ID != 0 || len(root.in) != 0 {
+		t.Errorf("expected the unbuilt root without IDs, got ID %d", root.ID)
+	}
+	if !root.Advance(A).Advance(B).Finished() {
+		t.Errorf("expected the unbuilt root to be usable")
+	}
+}
+
+// offsetIDs generates IDs counting up from a base.
+type offsetIDs struct {
+	next int
+}
+
+func (ids *offsetIDs) Next() int {
+	ids.next++
+	return ids.next
+}
+
+func TestBuildWith(t *testing.T) {
+	sequential := a.THEN(b).OR(c).Build()
+	flow := a.THEN(b).OR(c).BuildWith(&offsetIDs{1000})
+	if flow.ID != 1001 {
+		t.Errorf("expected root to get the first generated ID, got %d", flow.ID)
+	}
+	if len(flow.InDegrees()) != 3 || flow.Advance(A).ID != sequential.Advance(A).ID+1000 || flow.Advance(C).ID != sequential.Advance(C).ID+1000 {
+		t.Errorf("expected generated IDs to follow the sequential numbering, got %v", flow.InDegrees())
+	}
+	if flow.FindByID(sequential.Advance(C).ID+1000) != flow.Advance(C) {
+		t.Errorf("expected to find state by generated ID")
+	}
+	if !flow.Advance(A).Advance(B).Finished() {
+		t.Errorf("expected flow built with generated IDs to advance as usual")
+	}
+
+	// IDs far apart enough that a slice indexed by ID would exhaust memory
+	namespaced := a.THEN(b).OR(c).BuildWith(&offsetIDs{1 << 40})
+	end := namespaced.Advance(C)
+	endID := end.ID
+	namespaced.CountEntries()
+	namespaced.Advance(C)
+	if end.ID != endID || namespaced.EntryCounts()[endID] != 1 {
+		t.Errorf("expected entries to be counted by generated ID, got %v", namespaced.EntryCounts())
+	}
+	encoded, err := EncodeFlow(namespaced, nameTest)
+	if err != nil {
+		t.Fatalf("unable to encode flow: %s", err)
+	}
+	decoded, err := DecodeFlow(encoded, testNames)
+	if err != nil {
+		t.Fatalf("unable to decode %s: %s", encoded, err)
+	}
+	if decoded.ID != namespaced.ID || decoded.Advance(C).ID != endID {
+		t.Errorf("expected decoded flow to keep the generated IDs")
+	}
+}
+
+func TestAdvanceAny(t *testing.T) {
+	var fired int
+	flow := a.THEN(b).OR(c).DO(func(data EventData) {
+		fired++
+	}).Build()
+
+	state, data, advanced := flow.AdvanceAny([]EventData{D, A, C})
+	if !advanced || data != A || state != flow.Advance(A) {
+		t.Errorf("expected the only matching event A to advance the flow, got %v", data)
+	}
+	state, data, advanced = state.AdvanceAny([]EventData{C, B})
+	if !advanced || data != C || !state.Finished() || fired != 1 {
+		t.Errorf("expected the first matching event to advance the flow once, got %v and %d actions", data, fired)
+	}
+	if same, data, advanced := flow.AdvanceAny([]EventData{B, D}); advanced || same != flow || data != nil {
+		t.Errorf("expected no matching event to leave the flow where it was")
+	}
+}
+
+func TestCopyAndedStates(t *testing.T) {
+	flow := a.AND(b).THEN(c)
+	found := 0
+	flow.root().each(func(s *State) {
+		if len(s.andedStates) > 0 {
+			found++
+		}
+		for _, anded := range s.andedStates {
+			if anded == nil {
+				t.Errorf("copy left a nil anded state")
+			}
+		}
+	})
+	if found != 1 {
+		t.Errorf("expected copy to keep the anded states of the AND, found %d", found)
+	}
+	for _, anded := range a.AND(b).copy().andedStates {
+		if anded == nil {
+			t.Errorf("copy left a nil anded state")
+		}
+	}
+}
+
+func TestANDTHEN(t *testing.T) {
+	flow := a.AND(b).THEN(c)
+	for _, events := range [][]string{{A, B, C}, {B, A, C}} {
+		if !finishes(flow, events) {
+			t.Errorf("expected %v to finish", events)
+		}
+	}
+	for _, events := range [][]string{{A, C, B}, {C, A, B}} {
+		if finishes(flow, events) {
+			t.Errorf("expected %v not to finish, since C must come last", events)
+		}
+	}
+}
+
+func TestReusedSubflow(t *testing.T) {
+	fired := 0
+	inner := a.THEN(b).DO(func(data EventData) {
+		fired++
+	})
+
+	sequence := c.THEN(inner).THEN(inner).Build()
+	first := sequence.Advance(C).Advance(A)
+	if first.Advance(A) != first {
+		t.Errorf("expected the second use of the sub-flow not to start before the first finishes")
+	}
+	second := first.Advance(B)
+	if second.Finished() || fired != 1 {
+		t.Errorf("expected the first use of the sub-flow to finish on its own")
+	}
+	if !second.Advance(A).Advance(B).Finished() || fired != 2 {
+		t.Errorf("expected the second use of the sub-flow to advance from its start")
+	}
+
+	anded := inner.AND(inner)
+	if finishes(anded, []string{A, B}) || !finishes(anded, []string{A, A, B, B}) || !finishes(anded, []string{A, B, A, B}) {
+		t.Errorf("expected each use of the sub-flow in an AND to advance independently")
+	}
+	if !finishes(inner, []string{A, B}) {
+		t.Errorf("expected the sub-flow to be unaffected by its uses")
+	}
+}
+
+func TestSubflowFrom(t *testing.T) {
+	fired := 0
+	flow := a.AND(b).THEN(c.THEN(d)).DO(func(data EventData) {
+		fired++
+	}).Build()
+	andEnd := flow.Advance(A).Advance(B)
+
+	tail := flow.SubflowFrom(andEnd.ID)
+	if tail == nil || tail.ID != 1 || len(tail.in) != 0 {
+		t.Fatalf("expected tail to be the root of its own flow")
+	}
+	if tail.countChildren() >= flow.countChildren() {
+		t.Errorf("expected tail to leave out the AND")
+	}
+	if !tail.Advance(C).Advance(D).Finished() || fired != 1 {
+		t.Errorf("expected tail to advance independently and fire its action")
+	}
+	if len(andEnd.in) == 0 || flow.Advance(B).Advance(A) != andEnd {
+		t.Errorf("expected extracting tail to leave flow unchanged")
+	}
+	if flow.SubflowFrom(1000) != nil {
+		t.Errorf("expected no subflow for unknown ID")
+	}
+}
+
+func TestTransitionFunc(t *testing.T) {
+	fired := 0
+	flow := a.THEN(b.AND(c)).OR(d).DO(func(data EventData) {
+		fired++
+	}).Build()
+	transition := flow.TransitionFunc()
+
+	state, id := flow, flow.ID
+	for _, event := range []string{C, A, F, C, B} {
+		nextID, actionFired := transition(id, event)
+		before := fired
+		state = state.Advance(event)
+		if nextID != state.ID || actionFired != (fired > before) {
+			t.Errorf("expected %s to lead to state %d, got %d", event, state.ID, nextID)
+		}
+		id = nextID
+	}
+	if !state.Finished() || fired != 2 {
+		t.Errorf("expected both to finish the flow and fire its action")
+	}
+	if id, actionFired := transition(1000, A); id != 1000 || actionFired {
+		t.Errorf("expected unknown ID to be returned unchanged")
+	}
+}
+
+func TestCompleteTogether(t *testing.T) {
+	if finishes(a.AND(a), []string{A}) || !finishes(a.AND(a), []string{A, A}) {
+		t.Errorf("expected each event to advance one branch by default")
+	}
+	if !finishes(a.AND(a).CompleteTogether(), []string{A}) {
+		t.Errorf("expected one event to complete both branches")
+	}
+
+	together := a.THEN(b).AND(b).CompleteTogether()
+	if !finishes(together, []string{A, B}) {
+		t.Errorf("expected final B to complete both pending branches")
+	}
+	if finishes(together, []string{B, A}) || !finishes(together, []string{B, A, B}) {
+		t.Errorf("expected event that finishes only one branch to advance only that branch")
+	}
+	if !finishes(a.THEN(b).AND(b).CompleteTogether().THEN(c), []string{A, B, C}) {
+		t.Errorf("expected completing together to survive THEN")
+	}
+}
+
+// findByIDUnvisited is FindByID without its visited set, which searches the
+// States shared by several branches once per branch.
+func findByIDUnvisited(state *State, id int) *State {
+	pending := []*State{state}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if current.ID == id {
+			return current
+		}
+		for i := len(current.out) - 1; i >= 0; i-- {
+			pending = append(pending, current.out[i].to)
+		}
+	}
+	return nil
+}
+
+func TestFindByIDShared(t *testing.T) {
+	flow := a.AND(b).AND(c).AND(d).Build()
+	flow.each(func(s *State) {
+		if found := flow.FindByID(s.ID); found != findByIDUnvisited(flow, s.ID) {
+			t.Errorf("expected FindByID to find the same State %d as before", s.ID)
+		}
+	})
+	if flow.FindByID(-1) != nil {
+		t.Errorf("expected no State with ID -1")
+	}
+}
+
+func BenchmarkFindByID(bm *testing.B) {
+	flows := map[string]*State{
+		"and": a.AND(b).AND(c).AND(d).Build(),
+		"or":  a.OR(b).THEN(a.OR(b)).THEN(a.OR(b)).THEN(a.OR(b)).THEN(a.OR(b)).Build(),
+	}
+	missing := -1
+	for name, flow := range flows {
+		flow := flow
+		bm.Run(name+"/unvisited", func(bm *testing.B) {
+			for i := 0; i < bm.N; i++ {
+				findByIDUnvisited(flow, missing)
+			}
+		})
+		bm.Run(name+"/visited", func(bm *testing.B) {
+			for i := 0; i < bm.N; i++ {
+				flow.FindByID(missing)
+			}
+		})
+	}
+}
+
+func TestFork(t *testing.T) {
+	var fired int
+	flow := a.THEN(b.OR(c)).THEN(d).DO(func(data EventData) {
+		fired++
+	}).Build()
+	state := flow.Advance(A)
+
+	fork := state.Fork()
+	if fork == state || fork.ID != state.ID || fork.Reset() == flow {
+		t.Errorf("expected a separate copy at the same position")
+	}
+	if forked := fork.Advance(B); forked.ID != state.Advance(B).ID || fork.Reset().FindByID(forked.ID) != forked {
+		t.Errorf("expected the fork to keep the IDs of the original flow")
+	}
+	if !fork.Advance(C).Advance(D).Finished() || fired != 1 {
+		t.Errorf("expected the fork to advance with the actions of the original flow, fired %d", fired)
+	}
+	if state.Advance(D) != state || flow.FindByID(state.ID) != state {
+		t.Errorf("expected advancing the fork to leave the original alone")
+	}
+	if !state.Advance(B).Advance(D).Finished() || fork.Advance(D) != fork {
+		t.Errorf("expected advancing the original to leave the fork alone")
+	}
+
+	lazy := a.LAZYAND(b).THEN(c).Build().Advance(A)
+	if !lazy.Fork().Advance(B).Advance(C).Finished() {
+		t.Errorf("expected a position inside a lazily evaluated AND to fork")
+	}
+}
+
+func TestBuildSafe(t *testing.T) {
+	if flow, err := a.THEN(b).OR(c).BuildSafe(); err != nil || flow.ID != 1 || len(flow.in) != 0 {
+		t.Errorf("expected acyclic flow to build, got %v", err)
+	}
+
+	flow := NamedTest("a", a).THEN(NamedTest("b", b)).THEN(NamedTest("c", c)).Build()
+	afterA, end := flow.Advance(A), flow.Advance(A).Advance(B).Advance(C)
+	back := &transition{test: NamedTest("d", d)}
+	end.addOut(back)
+	afterA.addIn(back)
+	_, err := end.BuildSafe()
+	if err == nil || err.Error() != "the transitions form a cycle (b -> c -> d)" {
+		t.Errorf("expected cycle through b, c and d to be reported, got %v", err)
+	}
+
+	loop := new(State)
+	self := &transition{test: a}
+	loop.addOut(self)
+	loop.addIn(self)
+	if _, err := loop.BuildSafe(); err == nil {
+		t.Errorf("expected flow without a root to be reported")
+	}
+}
+
+func TestRootCache(t *testing.T) {
+	flow := a.THEN(b).Build()
+	end := flow.Advance(A).Advance(B)
+	if end.root() != flow {
+		t.Errorf("expected the root of the built flow")
+	}
+	prefixed := c.THEN(flow)
+	if prefixed.root() == flow || prefixed.root().ID != 0 {
+		t.Errorf("expected the root of the composed flow rather than the cached one")
+	}
+	if end.root() != flow {
+		t.Errorf("expected composing a copy to leave the built flow alone")
+	}
+	start := new(State)
+	link := &transition{test: c}
+	start.addOut(link)
+	flow.addIn(link)
+	if end.root() != start {
+		t.Errorf("expected adding in front of the root to invalidate the cache")
+	}
+}
+
+// rootUncached is root without the cache kept by Build.
+func rootUncached(state *State) *State {
+	for len(state.in) > 0 {
+		state = state.in[0].from
+	}
+	return state
+}
+
+func BenchmarkRoot(bm *testing.B) {
+	chain := a.REPEAT(1000).Build()
+	end := chain.FindByID(1001)
+	bm.Run("uncached", func(bm *testing.B) {
+		for i := 0; i < bm.N; i++ {
+			rootUncached(end)
+		}
+	})
+	bm.Run("cached", func(bm *testing.B) {
+		for i := 0; i < bm.N; i++ {
+			end.root()
+		}
+	})
+}
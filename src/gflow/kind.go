@@ -0,0 +1,56 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+// StateKind describes the role that a State plays in the structure of a
+// flow, as determined by the operator that created it.
+type StateKind int
+
+const (
+	// KindNormal is the kind of every State not listed below, including the
+	// States along a chain of THENs and the intermediate States that OR and
+	// AND build between their start and end.
+	KindNormal StateKind = iota
+	// KindORStart is the kind of the State at which an OR starts.
+	KindORStart
+	// KindOREnd is the kind of the common end of an OR, as well as of the
+	// separate ends that OR gives branches finishing with an outcome.
+	KindOREnd
+	// KindANDStart is the kind of the State at which an AND or LAZYAND
+	// starts.
+	KindANDStart
+	// KindANDEnd is the kind of the common end of an AND or LAZYAND.
+	KindANDEnd
+	// KindBarrierStart is the kind of the State at which a barrier starts.
+	KindBarrierStart
+	// KindBarrierEnd is the kind of the State at which a barrier's source
+	// flows join.
+	KindBarrierEnd
+	// KindFallbackStart is the kind of the State at which a Fallback starts.
+	KindFallbackStart
+	// KindFallbackEnd is the kind of the common end of a Fallback.
+	KindFallbackEnd
+	// KindXORStart is the kind of the State at which an XOR starts.
+	KindXORStart
+	// KindXOREnd is the kind of the common end of an XOR.
+	KindXOREnd
+)
+
+var kindNames = []string{"normal", "or-start", "or-end", "and-start", "and-end", "barrier-start", "barrier-end", "fallback-start", "fallback-end", "xor-start", "xor-end"}
+
+func (kind StateKind) String() string {
+	if kind < 0 || int(kind) >= len(kindNames) {
+		return "unknown"
+	}
+	return kindNames[kind]
+}
+
+// Kind returns the role that the given State plays in the structure of its
+// flow.  When THEN continues a flow with another, the root of the other flow
+// is merged into the end of the flow being continued.  The merged State
+// keeps the kind of that end unless it is KindNormal, in which case it takes
+// the kind of the root.
+func (state *State) Kind() StateKind {
+	return state.kind
+}
@@ -0,0 +1,34 @@
+package gflow
+
+import (
+	"testing"
+)
+
+func TestKind(t *testing.T) {
+	or := a.OR(b).Build()
+	if or.Kind() != KindORStart {
+		t.Errorf("expected OR to start with %s, got %s", KindORStart, or.Kind())
+	}
+	if end := or.Advance(A); end.Kind() != KindOREnd || or.Advance(B) != end {
+		t.Errorf("expected OR to end with %s, got %s", KindOREnd, end.Kind())
+	}
+
+	and := a.AND(b).Build()
+	if and.Kind() != KindANDStart {
+		t.Errorf("expected AND to start with %s, got %s", KindANDStart, and.Kind())
+	}
+	if middle := and.Advance(A); middle.Kind() != KindNormal {
+		t.Errorf("expected interleaving to be %s, got %s", KindNormal, middle.Kind())
+	}
+	if end := and.Advance(A).Advance(B); end.Kind() != KindANDEnd {
+		t.Errorf("expected AND to end with %s, got %s", KindANDEnd, end.Kind())
+	}
+
+	then := c.THEN(a.OR(b)).Build()
+	if then.Kind() != KindNormal || then.Advance(C).Kind() != KindORStart {
+		t.Errorf("expected THEN to merge OR start into end of first flow")
+	}
+	if copied := then.copy(); copied.Advance(C).Advance(A).Kind() != KindOREnd {
+		t.Errorf("expected copy to preserve kinds")
+	}
+}
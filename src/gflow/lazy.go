@@ -0,0 +1,211 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+/*
+   LAZYAND constructs the same flow as AND, except that the interleavings of
+   state and other are not built up front.
+
+   AND builds a State for every possible interleaving of its branches, which
+   grows factorially with the number of branches.  LAZYAND instead keeps a
+   cursor into each branch and works out the next position while advancing,
+   trading CPU on every Advance for a flow whose size is the sum, rather than
+   the product, of its branches.  AND remains the better choice for small
+   flows.
+
+   The positions inside a lazily evaluated AND are created while advancing,
+   so they have no ID and can't be retrieved with FindByID.  Combining a
+   lazily evaluated AND using OR or AND builds out its interleavings in full,
+   unless the flows combined by AND are set to be evaluated lazily with Lazy,
+   in which case AND evaluates them the same as LAZYAND.
+*/
+func (state *State) LAZYAND(other stateSource) *State {
+	otherState := other.state()
+	// Create a common start node
+	start := new(State)
+	// Create a common end node
+	end := new(State)
+
+	andedStates := state.andedStates
+	if len(andedStates) == 0 {
+		andedStates = append(andedStates, state)
+	}
+	andedStates = append(andedStates, otherState)
+	end.andedStates = andedStates
+
+	start.kind, end.kind = KindANDStart, KindANDEnd
+	for _, andedState := range andedStates {
+		start.lazy = append(start.lazy, andedState.root())
+	}
+	link := &transition{from: start, to: end}
+	start.addOut(link)
+	end.addIn(link)
+
+	return end
+}
+
+func (test Test) LAZYAND(other stateSource) *State {
+	return test.state().LAZYAND(other)
+}
+
+// stepLazy finds the transition that the given EventData triggers from a
+// lazily evaluated State by advancing whichever branch cursor accepts it.
+func (state *State) stepLazy(data EventData, perms []string) *transition {
+	if state.barrier {
+		return state.stepBarrier(data, perms)
+	}
+	for i, branch := range state.lazy {
+		branchTrans := branch.step(data, perms)
+		if branchTrans != nil {
+			return state.lazyMove(i, branchTrans)
+		}
+	}
+	return nil
+}
+
+// movesLazy returns the transitions that can be taken from a lazily
+// evaluated State, which are those that can be taken by any of its branch
+// cursors.
+func (state *State) movesLazy() []*transition {
+	var moves []*transition
+	for i, branch := range state.lazy {
+		for _, branchTrans := range branch.moves() {
+			moves = append(moves, state.lazyMove(i, branchTrans))
+		}
+	}
+	return moves
+}
+
+// lazyMove creates the transition from a lazily evaluated State that results
+// from taking the given transition on the branch cursor with the given index.
+// Unless that finishes every branch, the transition leads to a newly created
+// State holding the updated cursors.
+func (state *State) lazyMove(index int, branchTrans *transition) *transition {
+	return state.lazyTo(replace(state.lazy, index, branchTrans.to), branchTrans)
+}
+
+// lazyTo creates the transition from a lazily evaluated State to the State
+// holding the given branch cursors, copying the attributes of the given
+// branch transition.
+func (state *State) lazyTo(branches []*State, branchTrans *transition) *transition {
+	end := state.lazyEnd()
+	next := end
+	finished := allFinished(branches)
+	if state.fallback {
+		// A Fallback finishes with its primary flow
+		finished = branches[0].Finished()
+	}
+	if !finished {
+		next = &State{lazy: branches, barrier: state.barrier, fallback: state.fallback, validator: state.validator, equality: state.equality}
+		next.out = []*transition{&transition{from: next, to: end}}
+	}
+	trans := branchTrans.clone(state, next)
+	if next != end {
+		next.in = []*transition{trans}
+	}
+	return trans
+}
+
+// lazyEnd finds the end of the AND that a lazily evaluated State belongs to,
+// which is the target of the State's untested link transition.
+func (state *State) lazyEnd() *State {
+	return state.lazyLink().to
+}
+
+func (state *State) lazyLink() *transition {
+	for _, trans := range state.out {
+		if trans.test.isZero() && !trans.epsilon {
+			return trans
+		}
+	}
+	return nil
+}
+
+// eager returns the given State if its flow contains no lazily evaluated
+// ANDs.  Otherwise, it returns the corresponding State from a copy of the
+// flow in which every lazily evaluated AND has been built out in full.  For
+// a position inside a lazily evaluated AND, that copy starts at the position
+// (see copy) and builds out the rest of the AND from its cursors.
+func (state *State) eager() *State {
+	var lazyStates []*State
+	state.root().each(func(s *State) {
+		if s.lazy != nil {
+			lazyStates = append(lazyStates, s)
+		}
+	})
+	if len(lazyStates) == 0 {
+		return state
+	}
+
+	stateCopy := state.copy()
+	lazyStates = nil
+	stateCopy.root().each(func(s *State) {
+		if s.lazy != nil {
+			lazyStates = append(lazyStates, s)
+		}
+	})
+	for _, lazyState := range lazyStates {
+		link := lazyState.lazyLink()
+		end := link.to
+		lazyState.out = without(lazyState.out, link)
+		end.in = without(end.in, link)
+
+		branches := make([]*State, len(lazyState.lazy))
+		for i, branch := range lazyState.lazy {
+			branches[i] = branch.eager()
+		}
+		lazyState.lazy = nil
+		lazyState.barrier = false
+		if lazyState.fallback {
+			lazyState.fallback = false
+			lazyState.addFallbackStates(branches[0], branches[1], end)
+			continue
+		}
+		lazyState.andGroup = end
+		lazyState.addAndStates(branches, end)
+	}
+	return stateCopy
+}
+
+// lazySteps returns the smallest number of events needed to finish the
+// branches of a lazily evaluated State from their cursors, or -1 if they
+// can't be finished.  Like StepsToFinish, it counts barriers as though each
+// event advanced only one branch.
+func (state *State) lazySteps() int {
+	branches := state.lazy
+	if state.fallback {
+		// A Fallback finishes with its primary flow
+		branches = branches[:1]
+	}
+	total := 0
+	for _, branch := range branches {
+		steps := branch.StepsToFinish()
+		if steps < 0 {
+			return -1
+		}
+		total += steps
+	}
+	return total
+}
+
+// allFinished checks whether all of the given States are finished.
+func allFinished(states []*State) bool {
+	for _, state := range states {
+		if !state.Finished() {
+			return false
+		}
+	}
+	return true
+}
+
+// without returns the given transitions minus the given transition.
+func without(transitions []*transition, trans *transition) []*transition {
+	var result []*transition
+	for _, t := range transitions {
+		if t != trans {
+			result = append(result, t)
+		}
+	}
+	return result
+}
@@ -0,0 +1,157 @@
+package gflow
+
+import (
+	"strconv"
+	"testing"
+)
+
+// permutations returns every ordering of the given events.
+func permutations(events []string) [][]string {
+	if len(events) <= 1 {
+		return [][]string{events}
+	}
+	var result [][]string
+	for i, event := range events {
+		rest := append(append([]string{}, events[:i]...), events[i+1:]...)
+		for _, perm := range permutations(rest) {
+			result = append(result, append([]string{event}, perm...))
+		}
+	}
+	return result
+}
+
+func finishes(flow *State, events []string) bool {
+	state := flow.Build()
+	for _, event := range events {
+		state = state.Advance(event)
+	}
+	return state.Finished()
+}
+
+func TestLazyANDEquivalence(t *testing.T) {
+	eager := a.AND(b.THEN(c)).AND(d)
+	lazy := a.LAZYAND(b.THEN(c)).LAZYAND(d)
+
+	sequences := permutations([]string{A, B, C, D})
+	sequences = append(sequences, []string{A, B, D}, []string{C, B, A, D}, []string{F, D, A, B, C})
+	for _, sequence := range sequences {
+		if finishes(eager, sequence) != finishes(lazy, sequence) {
+			t.Errorf("eager and lazy AND disagree on sequence %s", sequence)
+		}
+	}
+}
+
+func TestLazyANDWide(t *testing.T) {
+	// Built eagerly, this AND would need 12! interleavings.
+	const width = 12
+	var events []string
+	flow := makeTest("0").state()
+	for i := 1; i < width; i++ {
+		flow = flow.LAZYAND(makeTest(strconv.Itoa(i)))
+	}
+	for i := width - 1; i >= 0; i-- {
+		events = append(events, strconv.Itoa(i))
+	}
+
+	succeeded := false
+	flow = flow.DO(func(data EventData) {
+		succeeded = true
+	}).Build()
+
+	state := flow
+	for i, event := range events {
+		if state.Finished() {
+			t.Fatalf("flow finished after only %d events", i)
+		}
+		state = state.Advance(event)
+	}
+	if !state.Finished() || !succeeded {
+		t.Errorf("wide lazy AND did not complete")
+	}
+}
+
+func TestLazyANDComposition(t *testing.T) {
+	then := a.LAZYAND(b).THEN(c)
+	if !finishes(then, []string{B, C, A, C}) {
+		t.Errorf("a.LAZYAND(b).THEN(c) did not complete")
+	}
+	if finishes(then, []string{A, C, B}) {
+		t.Errorf("a.LAZYAND(b).THEN(c) completed before c")
+	}
+
+	or := a.LAZYAND(b).OR(c)
+	if !finishes(or, []string{B, A}) || !finishes(or, []string{C}) {
+		t.Errorf("a.LAZYAND(b).OR(c) did not complete")
+	}
+}
+
+func TestLazyANDMidRun(t *testing.T) {
+	mid := a.LAZYAND(b).THEN(c).Build().Advance(A)
+	if mid.Finished() {
+		t.Fatalf("a.LAZYAND(b).THEN(c) finished after A")
+	}
+
+	if text := toText(t, mid); text == "" {
+		t.Errorf("ToText wrote nothing")
+	}
+	if dot := ToDot(mid, nameTest); dot == "" {
+		t.Errorf("ToDot wrote nothing")
+	}
+	if mermaid := ToMermaid(mid, nameTest); mermaid == "" {
+		t.Errorf("ToMermaid wrote nothing")
+	}
+	if _, err := EncodeFlow(mid, nameTest); err != nil {
+		t.Errorf("EncodeFlow failed: %s", err)
+	}
+	if steps := mid.StepsToFinish(); steps != 2 {
+		t.Errorf("StepsToFinish is %d, not 2", steps)
+	}
+
+	adapted := Adapt(mid, func(data EventData) EventData { return data })
+	if !finishes(adapted, []string{B, C}) {
+		t.Errorf("Adapt did not continue from the position")
+	}
+	or := mid.OR(d)
+	if !finishes(or, []string{B, C}) || !finishes(or, []string{D}) {
+		t.Errorf("OR did not continue from the position")
+	}
+	and := mid.AND(d)
+	if !finishes(and, []string{D, B, C}) || finishes(and, []string{B, C}) {
+		t.Errorf("AND did not continue from the position")
+	}
+	xor := mid.XOR(d)
+	if !finishes(xor, []string{B, C}) || !finishes(xor, []string{D}) {
+		t.Errorf("XOR did not continue from the position")
+	}
+}
+
+func TestLazyOption(t *testing.T) {
+	if a.AND(b).root().lazy != nil {
+		t.Errorf("AND was evaluated lazily by default")
+	}
+
+	// Built eagerly, this AND would need 12! interleavings.
+	const width = 12
+	var events []string
+	flow := makeTest("0").state().Lazy()
+	for i := 1; i < width; i++ {
+		flow = flow.AND(makeTest(strconv.Itoa(i)))
+	}
+	for i := width - 1; i >= 0; i-- {
+		events = append(events, strconv.Itoa(i))
+	}
+	if flow.root().lazy == nil {
+		t.Fatalf("AND of a Lazy flow was evaluated eagerly")
+	}
+	if !finishes(flow, events) || finishes(flow, events[1:]) {
+		t.Errorf("AND of a Lazy flow did not complete with every branch")
+	}
+
+	eager := a.AND(b.THEN(c)).AND(d)
+	lazy := a.Lazy().AND(b.THEN(c)).AND(d)
+	for _, sequence := range permutations([]string{A, B, C, D}) {
+		if finishes(eager, sequence) != finishes(lazy, sequence) {
+			t.Errorf("eager and Lazy AND disagree on sequence %s", sequence)
+		}
+	}
+}
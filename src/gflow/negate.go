@@ -0,0 +1,28 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+/*
+   NOT returns a copy of the flow ending in the given State whose
+   transitions are taken for events that fail their Tests rather than for
+   events that pass them, so a.THEN(b.NOT()) advances past the second step
+   on any event other than a B.  Epsilon transitions are left as they are.
+
+   Negated transitions follow the same rules as any other transition: each
+   event triggers at most one transition, so an event that passes both a
+   negated Test and a sibling Test advances only one of them.  Since
+   negated Tests cost more than the Tests they negate, the sibling is
+   usually the one taken (see Not).  Negated Tests are built with Not, so
+   negating the same Test twice in different flows yields transitions that
+   OR merges.
+*/
+func (state *State) NOT() *State {
+	negated := state.copy()
+	negated.root().mapTests(Not)
+	return negated
+}
+
+func (test Test) NOT() *State {
+	return test.state().NOT()
+}
@@ -0,0 +1,44 @@
+package gflow
+
+import (
+	"testing"
+)
+
+func TestNOT(t *testing.T) {
+	flow := a.THEN(b.NOT()).Build()
+	if state := flow.Advance(A).Advance(B); state.Finished() {
+		t.Errorf("expected B to be rejected by negated test")
+	}
+	if !finishes(flow, []string{A, B, C}) || !finishes(flow, []string{A, D}) {
+		t.Errorf("expected events other than B to pass negated test")
+	}
+	if finishes(flow, []string{C}) {
+		t.Errorf("expected negation to apply only to the negated flow")
+	}
+}
+
+func TestNOTWithOR(t *testing.T) {
+	var fired int
+	flow := b.NOT().DO(func(data EventData) {
+		fired++
+	}).OR(c.THEN(d)).Build()
+	if !flow.Advance(C).Advance(D).Finished() {
+		t.Errorf("expected C to advance the positive branch")
+	}
+	if fired != 0 {
+		t.Errorf("expected negated branch not to fire alongside sibling, fired %d times", fired)
+	}
+	if !flow.Advance(A).Finished() || flow.Advance(B).Finished() {
+		t.Errorf("expected only events other than B and C to finish negated branch")
+	}
+}
+
+func TestNOTWithAND(t *testing.T) {
+	flow := a.AND(c.NOT())
+	if !finishes(flow, []string{A, B}) || !finishes(flow, []string{D, A}) {
+		t.Errorf("expected AND with negated branch to finish")
+	}
+	if finishes(flow, []string{C, A}) || finishes(flow, []string{A}) {
+		t.Errorf("expected AND with negated branch to need an event for each branch")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"fmt"
+)
+
+/*
+   Provenance returns a copy of the flow ending in the given State whose
+   transitions are labeled as coming from the sub-flow with the given name,
+   so that diagnostics about a large composition can say which of its parts
+   they concern.  BuildStrict reports the provenance of the transitions it
+   objects to, DeadTransitions includes it in each Transition, and Canonical
+   and ToDot write it after the name of each Test, in square brackets.
+
+   Operators copy transitions along with their provenance, so the labels
+   survive THEN, OR, AND and the like.  Transitions that are already labeled
+   keep their labels, so labeling a composed flow names only the parts that
+   weren't labeled by their own sub-flows.  When OR merges transitions that
+   have the same Test, the merged transition keeps the provenance of only
+   one of them.
+*/
+func (state *State) Provenance(name string) *State {
+	labeled := state.copy()
+	labeled.root().labelSources(name)
+	return labeled
+}
+
+func (test Test) Provenance(name string) *State {
+	return test.state().Provenance(name)
+}
+
+// Sources returns the distinct provenance labels (see Provenance) of the
+// transitions into and out of the given State, in the order in which they
+// are first encountered.
+func (state *State) Sources() []string {
+	var sources []string
+	for _, trans := range append(append([]*transition(nil), state.in...), state.out...) {
+		if trans.source != "" && !containsString(sources, trans.source) {
+			sources = append(sources, trans.source)
+		}
+	}
+	return sources
+}
+
+// labelSources labels every unlabeled transition of the flow starting at the
+// given root in place.
+func (root *State) labelSources(name string) {
+	root.each(func(s *State) {
+		for _, trans := range s.out {
+			if trans.source == "" {
+				trans.source = name
+			}
+		}
+		for _, branch := range s.lazy {
+			branch.labelSources(name)
+		}
+	})
+}
+
+// provenance describes the provenance of the given transition for error
+// messages, or returns "" if it isn't labeled.
+func (trans *transition) provenance() string {
+	if trans.source == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (from %q)", trans.source)
+}
+
+// containsString checks whether the given strings include the given string.
+func containsString(strings []string, s string) bool {
+	for _, candidate := range strings {
+		if candidate == s {
+			return true
+		}
+	}
+	return false
+}
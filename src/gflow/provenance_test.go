@@ -0,0 +1,38 @@
+package gflow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	checkout := a.THEN(b).Provenance("checkout")
+	refund := a.THEN(c).Provenance("refund")
+	flow := checkout.OR(d.THEN(refund)).Provenance("orders")
+
+	_, err := flow.BuildStrict()
+	if err == nil || !strings.Contains(err.Error(), `(from "checkout")`) {
+		t.Errorf("expected error to name the sub-flow of the impure test, got %v", err)
+	}
+
+	built := flow.Build()
+	afterD := built.Advance(D)
+	if sources := afterD.Sources(); len(sources) != 2 || sources[0] != "orders" {
+		t.Errorf("expected state after D to be reached from orders, got %v", sources)
+	}
+	partial := a.Provenance("first").THEN(b).Build()
+	if sources := partial.Sources(); len(sources) != 1 || sources[0] != "first" {
+		t.Errorf("expected root to come from first, got %v", sources)
+	}
+	if sources := partial.Advance(A).Advance(B).Sources(); len(sources) != 0 {
+		t.Errorf("expected unlabeled transition to have no provenance, got %v", sources)
+	}
+	if dump := built.Canonical(); !strings.Contains(dump, "t1 [checkout] -> ") || !strings.Contains(dump, "[orders]") {
+		t.Errorf("expected dump to include provenance, got\n%s", dump)
+	}
+
+	dead := a.THEN(All(Equals("z"), Not(Equals("z")))).Provenance("broken").OR(b).Build().DeadTransitions()
+	if len(dead) != 1 || dead[0].Source != "broken" {
+		t.Errorf("expected dead transition to come from broken, got %v", dead)
+	}
+}
@@ -0,0 +1,541 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Runner tracks a single run through a flow.  States leave keeping track of
+// the current State of a flow to the client program, which is all that many
+// programs need.  A Runner is for programs that would rather have gflow keep
+// track of the current State, along with anything else scoped to the run.
+//
+// Unlike States, Runners are mutable and are not safe for concurrent use.
+type Runner struct {
+	state       *State
+	merge       Merge
+	accumulated EventData
+	maxEvents   int
+	events      int
+	vars        Vars
+	transforms  []Projection
+	onComplete  func(finalState *State, data EventData)
+	finished    bool
+	recording   bool
+	session     string
+	clock       Clock
+	entered     time.Time
+	started     time.Time
+	slaOutcome  string
+	log         []TransitionRecord
+	fired       []Test
+	resumed     bool
+	window      time.Duration
+	windowed    bool
+	latest      time.Time
+}
+
+// TransitionRecord records a transition taken during a run.  See
+// Runner.Record.
+type TransitionRecord struct {
+	Time        time.Time
+	Session     string
+	From        int
+	To          int
+	Test        string
+	ActionFired bool
+}
+
+// Vars holds variables scoped to a single run, which conditions on actions
+// can consult (see DOIf).
+type Vars map[string]interface{}
+
+// ErrRunTooLong is returned by Runner.Advance once a run has been sent more
+// events than its limit allows.  See Runner.Limit.
+var ErrRunTooLong = errors.New("run exceeded its maximum number of events")
+
+// ErrOutOfOrder is returned by Runner.Advance for Timestamped events that
+// occurred too long before the latest event of the run.  See Runner.Window.
+var ErrOutOfOrder = errors.New("event occurred before the window of the run")
+
+// Merge combines the event accumulated so far during a run with the next
+// event.  The accumulated event is nil when the first event is merged.
+type Merge func(accumulated EventData, data EventData) EventData
+
+// Run starts a new run through the flow from the given State.
+func (state *State) Run() *Runner {
+	return newRunner(state)
+}
+
+// newRunner creates a Runner at the given State, timing the run using
+// time.Now.
+func newRunner(state *State) *Runner {
+	now := time.Now()
+	return &Runner{state: state, clock: time.Now, entered: now, started: now}
+}
+
+// Accumulate has the Runner merge each event that triggers a transition into
+// an accumulated event using the given Merge, or using MergeMaps if merge is
+// nil.  Actions are then passed the accumulated event rather than the event
+// that triggered them, which allows the action at the end of an AND to see
+// the data carried by the events of every branch.
+func (r *Runner) Accumulate(merge Merge) *Runner {
+	if merge == nil {
+		merge = MergeMaps
+	}
+	r.merge = merge
+	return r
+}
+
+// MergeMaps is the default Merge.  When both the accumulated event and the
+// next event are of type map[string]interface{}, it returns a new map with
+// the keys of both, preferring the values of the next event where they share
+// a key.  Otherwise, the next event simply replaces the accumulated event.
+func MergeMaps(accumulated EventData, data EventData) EventData {
+	accumulatedMap, ok := accumulated.(map[string]interface{})
+	if !ok {
+		return data
+	}
+	dataMap, ok := data.(map[string]interface{})
+	if !ok {
+		return data
+	}
+	merged := make(map[string]interface{}, len(accumulatedMap)+len(dataMap))
+	for key, value := range accumulatedMap {
+		merged[key] = value
+	}
+	for key, value := range dataMap {
+		merged[key] = value
+	}
+	return merged
+}
+
+// Limit limits the run to the given number of events, protecting against
+// event sources that never stop sending events to a run that can't finish.
+// Every event counts towards the limit, whether or not it triggers a
+// transition.  A limit of 0, the default, means no limit.
+func (r *Runner) Limit(maxEvents int) *Runner {
+	r.maxEvents = maxEvents
+	return r
+}
+
+// Window has the Runner accept Timestamped events that arrive out of order,
+// as long as they occurred no more than the given duration before the latest
+// event that the run has been sent.  Advance rejects events that occurred
+// earlier than that with ErrOutOfOrder, leaving the run where it is.  Flows
+// that don't depend on the order of their events, such as ANDs, thereby
+// handle events that arrive late within the window, whereas a window of 0
+// rejects every event that occurred before the latest.  A late event that
+// the window accepts is timed as having occurred at the latest time the run
+// has seen, so that the timing of the run never goes backwards.  By
+// default, the Runner doesn't check the order of events.
+func (r *Runner) Window(window time.Duration) *Runner {
+	r.window, r.windowed = window, true
+	return r
+}
+
+// OnComplete registers a callback that the Runner invokes once the run
+// finishes, meaning once Advance first leaves it at a finished State (see
+// Finished).  It's invoked after the Actions of that State, with the same
+// EventData, and is invoked only once per run, no matter how many events are
+// sent afterwards.  Unlike Actions, which belong to the States of a flow,
+// the callback belongs to the run.
+func (r *Runner) OnComplete(callback func(finalState *State, data EventData)) *Runner {
+	r.onComplete = callback
+	return r
+}
+
+// Clock has the Runner time the run using the given Clock rather than
+// time.Now.  Since the Runner times how long the run has been at its current
+// State (see AdvanceClock), this restarts the timing of the current State,
+// as well as of the whole run if it hasn't been sent any events yet (see
+// SLABreached).  Runs resumed from a token (see Resume) keep the times
+// recorded in the token.
+func (r *Runner) Clock(clock Clock) *Runner {
+	r.clock = clock
+	if r.resumed {
+		return r
+	}
+	r.entered = clock()
+	if r.events == 0 {
+		r.started = r.entered
+	}
+	return r
+}
+
+// SLABreached checks whether, at the given time, the run has missed the
+// deadline set for its flow using SLA, meaning that it hasn't finished
+// within the deadline of starting.  Runs through flows without a deadline
+// never breach it.
+func (r *Runner) SLABreached(now time.Time) bool {
+	deadline := r.state.root().sla
+	return deadline > 0 && !r.finished && now.Sub(r.started) > deadline
+}
+
+// FailOnSLA has AdvanceClock move runs that have breached the deadline of
+// their flow (see SLABreached) to a finished State of their own, labeled with
+// the given outcome (see Outcome).  That State isn't part of the flow, so it
+// has no ID.
+func (r *Runner) FailOnSLA(outcome string) *Runner {
+	r.slaOutcome = outcome
+	return r
+}
+
+// Record has the Runner keep a log of the transitions taken during the run
+// for the session with the given ID, timestamped using the given Clock (see
+// Runner.Clock), or using the Runner's current Clock if clock is nil, unless
+// the event that caused the transition carries its own time (see
+// Timestamped).
+// Transitions are logged by the IDs of the States they connect, so positions
+// inside a lazily evaluated AND are logged as 0.  Tests are logged by name
+// (see NamedTest) or else by key (see Keyer), or as "" if they have neither.
+func (r *Runner) Record(session string, clock Clock) *Runner {
+	if clock != nil {
+		r.Clock(clock)
+	}
+	r.recording, r.session = true, session
+	return r
+}
+
+// Log returns the transitions taken so far during the run, if it's being
+// recorded (see Record).
+func (r *Runner) Log() Tape {
+	return r.log
+}
+
+// Tape is the log of the transitions taken during a run, or during a segment
+// of a run that spans several Runners, for example because the client
+// program was restarted part way and resumed the run from a saved ID.  See
+// Runner.Record and MergeTapes.
+type Tape []TransitionRecord
+
+// MergeTapes concatenates the given segments of the tape of a run, in order,
+// to reconstruct the history of the whole run.  Each segment must start at
+// the State at which the previous segment ended and must belong to the same
+// session, or else MergeTapes returns an error describing the first
+// discontinuity.  Empty segments are skipped.
+func MergeTapes(tapes ...Tape) (Tape, error) {
+	var merged Tape
+	for i, tape := range tapes {
+		if len(tape) == 0 {
+			continue
+		}
+		if len(merged) > 0 {
+			last, first := merged[len(merged)-1], tape[0]
+			if first.Session != last.Session {
+				return nil, fmt.Errorf("segment %d is of session %q rather than %q", i, first.Session, last.Session)
+			}
+			if first.From != last.To {
+				return nil, fmt.Errorf("segment %d starts at state %d rather than state %d", i, first.From, last.To)
+			}
+		}
+		merged = append(merged, tape...)
+	}
+	return merged, nil
+}
+
+// State returns the current State of the run.
+func (r *Runner) State() *State {
+	return r.state
+}
+
+// Vars returns the variables of the run, which the client program may set
+// and conditions on actions may consult (see DOIf).
+func (r *Runner) Vars() Vars {
+	if r.vars == nil {
+		r.vars = make(Vars)
+	}
+	return r.vars
+}
+
+// Accumulated returns the event accumulated so far during the run, or nil
+// if the Runner isn't accumulating events.
+func (r *Runner) Accumulated() EventData {
+	return r.accumulated
+}
+
+// Advance advances the run based on the given EventData the same way as
+// State.Advance does and returns the new current State.  Once the run
+// exceeds its limit, Advance leaves the run where it is and returns
+// ErrRunTooLong.  Likewise, it returns the error from the flow's Validator
+// for events that fail validation (see WithValidator), and ErrOutOfOrder for
+// events that occurred before the Runner's Window.
+//
+// Once the run has passed the end of the first operand of a PIPE, Advance
+// validates each event as sent, but then passes it through the PIPE's
+// transform before testing it and handing it to any Actions.  Events that
+// repeat one that may only count once are ignored (see Once).
+//
+// A TickEvent is handled the same as a call to AdvanceClock at the time it
+// carries, and doesn't count towards the limit of the run.  The run is timed
+// as having reached its new State when any other Timestamped event occurred,
+// or else at the time given by the Runner's Clock.
+func (r *Runner) Advance(data EventData) (*State, error) {
+	if tick, ok := data.(TickEvent); ok {
+		return r.advanceClock(tick.Time()), nil
+	}
+	timestamped, hasTime := data.(Timestamped)
+	r.events++
+	if r.maxEvents > 0 && r.events > r.maxEvents {
+		return r.state, ErrRunTooLong
+	}
+	if err := r.state.validate(data); err != nil {
+		return r.state, err
+	}
+	if hasTime {
+		at := timestamped.Time()
+		if r.windowed && at.Before(r.latest.Add(-r.window)) {
+			return r.state, ErrOutOfOrder
+		}
+		if at.After(r.latest) {
+			r.latest = at
+		}
+	}
+	for _, transform := range r.transforms {
+		data = transform(data)
+	}
+	for _, test := range r.fired {
+		if test.Pass(data) {
+			// The event repeats one that may only count once
+			return r.state, nil
+		}
+	}
+	tran := r.state.step(data, nil)
+	if tran == nil {
+		return r.state, nil
+	}
+	if isOnce(tran.test) && !containsTest(r.fired, tran.test) {
+		r.fired = append(r.fired, tran.test)
+	}
+	if tran.transform != nil {
+		r.transforms = append(r.transforms, tran.transform)
+	}
+	if r.merge != nil {
+		r.accumulated = r.merge(r.accumulated, data)
+		data = r.accumulated
+	}
+	now := r.clock()
+	if hasTime {
+		now = timestamped.Time()
+		if r.windowed {
+			// A late event doesn't turn back the timing of the run
+			now = r.latest
+		}
+	}
+	r.take(tran, data, now)
+	return r.state, nil
+}
+
+// Once returns a Test that passes the same events as the given Test, but
+// that may only be satisfied once per run.  Once a Runner has taken a
+// transition with the returned Test, it ignores every later event that
+// passes it, for the rest of the run, whichever State the run is at.  This
+// models requirements that are either met or not, no matter how many times
+// they're met.  Advancing States directly doesn't track which Tests have
+// been satisfied, so the returned Test behaves the same as the given one.
+func Once(test Test) Test {
+	return Describe(test, once{test})
+}
+
+type once struct {
+	test Test
+}
+
+func (desc once) Key() string {
+	if testKey := key(desc.test); testKey != "" {
+		return "Once(" + testKey + ")"
+	}
+	return ""
+}
+
+func (desc once) Pure() bool {
+	return pure(desc.test)
+}
+
+// isOnce checks whether the given Test was created by Once.
+func isOnce(test Test) bool {
+	_, ok := describe(test).(once)
+	return ok
+}
+
+// AdvanceClock checks whether the run has been at its current State for
+// long enough to take one of its Timeout transitions, according to the
+// Runner's Clock.  If so, it takes the transition that times out soonest,
+// handing the current time to any Actions, and returns the new current State.
+// Otherwise, it leaves the run where it is.  Runs that have breached the
+// deadline of their flow are failed before any Timeout is considered, if so
+// configured (see FailOnSLA).  Client programs call AdvanceClock
+// periodically, for example from a time.Ticker.  AdvanceClock doesn't count
+// towards the limit of the run (see Limit).
+func (r *Runner) AdvanceClock() *State {
+	return r.advanceClock(r.clock())
+}
+
+// TickEvent is a synthetic event carrying the current time, which a client
+// program can send to Runner.Advance in place of calling AdvanceClock, for
+// example to feed time through the same channel as its other events.  It
+// implements Timestamped.
+//
+// States don't record when they were entered, since they're shared by every
+// run through the flow and never change once built, so only a Runner, which
+// tracks a single run, can tell how long the run has waited.  Advancing a
+// State directly with a TickEvent tests it like any other event, which
+// Timeouts never pass.
+type TickEvent time.Time
+
+func (tick TickEvent) Time() time.Time {
+	return time.Time(tick)
+}
+
+// advanceClock advances the run the same as AdvanceClock, taking the given
+// time as the current time.
+func (r *Runner) advanceClock(now time.Time) *State {
+	if r.slaOutcome != "" && r.SLABreached(now) {
+		failed := &State{outcome: r.slaOutcome}
+		r.take(&transition{from: r.state, to: failed}, now, now)
+		return r.state
+	}
+	elapsed := now.Sub(r.entered)
+	var due *transition
+	var dueAfter time.Duration
+	for _, trans := range r.state.moves() {
+		after, ok := timeoutAfter(trans.test)
+		if ok && trans.test.Pass(waitedFor(elapsed)) && (due == nil || after < dueAfter) {
+			due, dueAfter = trans, after
+		}
+	}
+	if due != nil {
+		r.take(due, now, now)
+	}
+	return r.state
+}
+
+// take moves the run along the given transition at the given time, handing
+// the given EventData to the Actions of the State it leads to.
+func (r *Runner) take(tran *transition, data EventData, now time.Time) {
+	r.state = tran.to
+	r.entered = now
+	fired := tran.enter(data, r.vars)
+	if r.recording {
+		r.log = append(r.log, TransitionRecord{
+			Time:        r.entered,
+			Session:     r.session,
+			From:        tran.from.ID,
+			To:          tran.to.ID,
+			Test:        label(tran.test),
+			ActionFired: fired,
+		})
+	}
+	if r.state.Finished() && !r.finished {
+		r.finished = true
+		if r.onComplete != nil {
+			r.onComplete(r.state, data)
+		}
+	}
+}
+
+// runTokenHeader starts every token produced by Suspend, identifying the
+// version of the token's format.
+const runTokenHeader = "gflow-run/1\n"
+
+// runToken is the serialized form of a suspended run.
+type runToken struct {
+	State       int
+	Accumulated EventData
+	Vars        Vars `json:",omitempty"`
+	Started     time.Time
+	Entered     time.Time
+	Events      int      `json:",omitempty"`
+	Fired       [][2]int `json:",omitempty"`
+}
+
+// Suspend captures the state of the run in an opaque token from which it can
+// be resumed using Resume, for example after a restart.  The flow must have
+// been built and the run must be at a State with an ID, so runs positioned
+// inside a lazily evaluated AND can't be suspended.  The accumulated event
+// and the run's Vars are encoded as JSON, so once resumed they hold the
+// types that encoding/json decodes into, such as float64 for numbers.  The
+// token also records when the run reached its current State, how many
+// events it has been sent (see Limit) and which Tests it may no longer
+// satisfy (see Once), the latter by the position of a transition that uses
+// each of them.
+//
+// Options set on the Runner, like Accumulate, aren't part of the token and
+// must be set again after resuming.  Neither are the transforms of any PIPEs
+// that the run has passed, so such runs can't be suspended.
+func (r *Runner) Suspend() ([]byte, error) {
+	if r.state.ID == 0 {
+		return nil, fmt.Errorf("run is at a state without an ID and can't be suspended")
+	}
+	if len(r.transforms) > 0 {
+		return nil, fmt.Errorf("run has passed a PIPE and can't be suspended")
+	}
+	decoded := runToken{State: r.state.ID, Accumulated: r.accumulated, Vars: r.vars, Started: r.started, Entered: r.entered, Events: r.events}
+	for _, test := range r.fired {
+		position, ok := r.state.root().transitionWith(test)
+		if !ok {
+			return nil, fmt.Errorf("run has satisfied a test that isn't at a state with an ID and can't be suspended")
+		}
+		decoded.Fired = append(decoded.Fired, position)
+	}
+	payload, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(runTokenHeader), payload...), nil
+}
+
+// Resume resumes a run through the flow from a token produced by Suspend.
+// The flow must have the same definition as the one from which the token was
+// produced (see FindByID).
+func (flow *State) Resume(token []byte) (*Runner, error) {
+	if !bytes.HasPrefix(token, []byte(runTokenHeader)) {
+		return nil, fmt.Errorf("token is not a run suspended by this version of gflow")
+	}
+	var decoded runToken
+	if err := json.Unmarshal(token[len(runTokenHeader):], &decoded); err != nil {
+		return nil, err
+	}
+	state := flow.root().FindByID(decoded.State)
+	if state == nil {
+		return nil, fmt.Errorf("flow has no state %d", decoded.State)
+	}
+	run := newRunner(state)
+	run.accumulated, run.vars, run.events = decoded.Accumulated, decoded.Vars, decoded.Events
+	if !decoded.Started.IsZero() {
+		run.started = decoded.Started
+	}
+	if !decoded.Entered.IsZero() {
+		run.entered, run.resumed = decoded.Entered, true
+	}
+	for _, position := range decoded.Fired {
+		from := flow.root().FindByID(position[0])
+		if from == nil || position[1] < 0 || position[1] >= len(from.out) {
+			return nil, fmt.Errorf("flow has no transition %d out of state %d", position[1], position[0])
+		}
+		run.fired = append(run.fired, from.out[position[1]].test)
+	}
+	return run, nil
+}
+
+// transitionWith finds a transition that uses the given Test in the flow
+// starting at the given root, returning the ID of the State it leaves and
+// its index among that State's outbound transitions.
+func (root *State) transitionWith(test Test) ([2]int, bool) {
+	var position [2]int
+	found := false
+	root.each(func(s *State) {
+		for i, trans := range s.out {
+			if !found && s.ID != 0 && !trans.test.isZero() && sameTest(trans.test, test) {
+				position, found = [2]int{s.ID, i}, true
+			}
+		}
+	})
+	return position, found
+}
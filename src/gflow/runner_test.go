@@ -0,0 +1,336 @@
+package gflow
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeKindTest(kind string) Test {
+	return NewTest(func(data EventData) bool {
+		return data.(map[string]interface{})["kind"] == kind
+	})
+}
+
+func TestAccumulate(t *testing.T) {
+	var completed map[string]interface{}
+	flow := makeKindTest("A").AND(makeKindTest("B")).DO(func(data EventData) {
+		completed = data.(map[string]interface{})
+	}).Build()
+
+	run := flow.Run().Accumulate(nil)
+	run.Advance(map[string]interface{}{"kind": "A", "x": 1, "shared": "a"})
+	run.Advance(map[string]interface{}{"kind": "C", "ignored": true})
+	run.Advance(map[string]interface{}{"kind": "B", "y": 2, "shared": "b"})
+
+	if !run.State().Finished() {
+		t.Fatalf("run did not finish")
+	}
+	if completed["x"] != 1 || completed["y"] != 2 {
+		t.Errorf("action did not see the fields of both events: %v", completed)
+	}
+	if completed["shared"] != "b" {
+		t.Errorf("expected the last event to win for shared keys, got %v", completed["shared"])
+	}
+	if _, ok := completed["ignored"]; ok {
+		t.Errorf("accumulated event includes an ignored event")
+	}
+}
+
+func TestAccumulateCustomMerge(t *testing.T) {
+	var completed EventData
+	flow := a.THEN(b).DO(func(data EventData) {
+		completed = data
+	}).Build()
+
+	run := flow.Run().Accumulate(func(accumulated EventData, data EventData) EventData {
+		if accumulated == nil {
+			return data
+		}
+		return accumulated.(string) + data.(string)
+	})
+	run.Advance(A)
+	run.Advance(B)
+	if completed != A+B {
+		t.Errorf("expected action to receive %q, got %v", A+B, completed)
+	}
+}
+
+func TestSuspendResume(t *testing.T) {
+	flow := a.AND(b.THEN(c)).THEN(d).Build()
+
+	run := flow.Run().Accumulate(func(accumulated EventData, data EventData) EventData {
+		if accumulated == nil {
+			return data
+		}
+		return accumulated.(string) + data.(string)
+	})
+	run.Advance(B)
+	run.Advance(A)
+	token, err := run.Suspend()
+	if err != nil {
+		t.Fatalf("unable to suspend run: %s", err)
+	}
+
+	resumed, err := flow.Resume(token)
+	if err != nil {
+		t.Fatalf("unable to resume run: %s", err)
+	}
+	if resumed.State() != run.State() {
+		t.Errorf("resumed run is at state %d rather than %d", resumed.State().ID, run.State().ID)
+	}
+	if resumed.Accumulated() != B+A {
+		t.Errorf("resumed run accumulated %v rather than %q", resumed.Accumulated(), B+A)
+	}
+	resumed.Advance(D)
+	resumed.Advance(C)
+	resumed.Advance(D)
+	if !resumed.State().Finished() {
+		t.Errorf("resumed run did not finish")
+	}
+}
+
+func TestSuspendResumeLimits(t *testing.T) {
+	now := epoch
+	clock := func() time.Time {
+		return now
+	}
+	flow := Once(a).THEN(a.OR(b).OR(Timeout(time.Minute).THEN(c))).Build()
+	run := flow.Run().Clock(clock).Limit(2)
+	run.Advance(A)
+	now = now.Add(30 * time.Second)
+	token, err := run.Suspend()
+	if err != nil {
+		t.Fatalf("unable to suspend run: %s", err)
+	}
+
+	resumed, err := flow.Resume(token)
+	if err != nil {
+		t.Fatalf("unable to resume run: %s", err)
+	}
+	resumed.Clock(clock).Limit(2)
+	if state, _ := resumed.Advance(A); state != run.State() {
+		t.Errorf("expected resumed run to ignore a test it already satisfied")
+	}
+	now = now.Add(30 * time.Second)
+	if resumed.AdvanceClock() == run.State() {
+		t.Errorf("expected resumed run to time out from when it reached its state")
+	}
+	if _, err := resumed.Advance(C); err != ErrRunTooLong {
+		t.Errorf("expected resumed run to count events sent before it was suspended, got %v", err)
+	}
+}
+
+func TestResumeInvalidToken(t *testing.T) {
+	flow := a.THEN(b).Build()
+	if _, err := flow.Resume([]byte(`{"State":1}`)); err == nil {
+		t.Errorf("expected error for token without version header")
+	}
+	if _, err := flow.Resume([]byte(runTokenHeader + `{"State":99}`)); err == nil {
+		t.Errorf("expected error for token with unknown state")
+	}
+	if _, err := a.THEN(b).Run().Suspend(); err == nil {
+		t.Errorf("expected error suspending run through unbuilt flow")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	run := a.THEN(b).Build().Run().Limit(3)
+	for i, event := range []string{A, C, C} {
+		if _, err := run.Advance(event); err != nil {
+			t.Fatalf("unexpected error for event %d: %s", i+1, err)
+		}
+	}
+	state, err := run.Advance(B)
+	if err != ErrRunTooLong {
+		t.Errorf("expected ErrRunTooLong once limit was exceeded, got %v", err)
+	}
+	if state.Finished() {
+		t.Errorf("run advanced past its limit")
+	}
+
+	run = a.THEN(b).Build().Run()
+	for i := 0; i < 1000; i++ {
+		run.Advance(C)
+	}
+	if _, err := run.Advance(A); err != nil {
+		t.Errorf("unexpected error for unlimited run: %s", err)
+	}
+}
+
+func TestDOIf(t *testing.T) {
+	notified, logged := 0, 0
+	firstCompletion := func(vars Vars) bool {
+		return vars["first"] == true
+	}
+	flow := a.THEN(b).DOIf(firstCompletion, func(data EventData) {
+		notified++
+	}).DO(func(data EventData) {
+		logged++
+	}).Build()
+
+	for completions := 0; completions < 2; completions++ {
+		run := flow.Run()
+		run.Vars()["first"] = completions == 0
+		run.Advance(A)
+		run.Advance(B)
+	}
+	if notified != 1 || logged != 2 {
+		t.Errorf("expected 1 notification and 2 logs, got %d and %d", notified, logged)
+	}
+
+	flow.Advance(A).Advance(B)
+	if notified != 1 || logged != 3 {
+		t.Errorf("expected condition to fail without Vars, got %d notifications", notified)
+	}
+
+	run := flow.Run()
+	run.Vars()["first"] = true
+	run.Advance(A)
+	token, err := run.Suspend()
+	if err != nil {
+		t.Fatalf("unable to suspend: %s", err)
+	}
+	resumed, err := flow.Resume(token)
+	if err != nil {
+		t.Fatalf("unable to resume: %s", err)
+	}
+	resumed.Advance(B)
+	if notified != 2 {
+		t.Errorf("expected Vars to survive suspending the run")
+	}
+}
+
+func TestPIPE(t *testing.T) {
+	enrich := func(data EventData) EventData {
+		return map[string]interface{}{"kind": data, "enriched": true}
+	}
+	var seen []EventData
+	flow := Equals("a").PIPE(enrich, NewTest(func(data EventData) bool {
+		event, ok := data.(map[string]interface{})
+		return ok && event["enriched"] == true && event["kind"] == "b"
+	}).state().DO(func(data EventData) {
+		seen = append(seen, data)
+	})).Build()
+
+	run := flow.Run()
+	if _, err := run.Advance("b"); err != nil || run.State() != flow {
+		t.Errorf("expected first stage to ignore events it doesn't accept")
+	}
+	run.Advance("a")
+	if _, err := run.Suspend(); err == nil {
+		t.Errorf("expected run past a PIPE not to be suspended")
+	}
+	if state, _ := run.Advance("c"); state.Finished() {
+		t.Errorf("expected ignored event to leave the run unchanged")
+	}
+	if state, _ := run.Advance("b"); !state.Finished() {
+		t.Fatalf("expected enriched event to finish the flow")
+	}
+	if len(seen) != 1 || seen[0].(map[string]interface{})["enriched"] != true {
+		t.Errorf("expected action to see the enriched event, got %v", seen)
+	}
+
+	if flow.Advance("a").Advance("b").Finished() {
+		t.Errorf("expected State.Advance to ignore transforms")
+	}
+}
+
+func TestOnComplete(t *testing.T) {
+	var completions []EventData
+	var final *State
+	run := a.THEN(b).Build().Run().OnComplete(func(finalState *State, data EventData) {
+		completions = append(completions, data)
+		final = finalState
+	})
+
+	for _, event := range []string{A, C, B, B, A, B} {
+		run.Advance(event)
+	}
+	if len(completions) != 1 || completions[0] != B || final != run.State() {
+		t.Errorf("expected one completion on B, got %v", completions)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	now := time.Date(2011, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	flow := Equals("submit").THEN(Equals("approve")).DO(func(data EventData) {}).Build()
+
+	run := flow.Run().Record("session-1", clock)
+	for _, event := range []string{"submit", "reject", "approve"} {
+		run.Advance(event)
+	}
+
+	log := run.Log()
+	if len(log) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(log))
+	}
+	expected := []TransitionRecord{
+		{time.Date(2011, 6, 1, 12, 2, 0, 0, time.UTC), "session-1", 1, 2, `Equals(string("submit"))`, false},
+		{time.Date(2011, 6, 1, 12, 3, 0, 0, time.UTC), "session-1", 2, 3, `Equals(string("approve"))`, true},
+	}
+	for i, record := range log {
+		if record != expected[i] {
+			t.Errorf("expected record %d to be %v, got %v", i, expected[i], record)
+		}
+	}
+
+	if log := flow.Run().Log(); log != nil {
+		t.Errorf("expected no log without recording, got %v", log)
+	}
+}
+
+func TestMergeTapes(t *testing.T) {
+	flow := Equals("submit").THEN(Equals("review")).THEN(Equals("approve")).Build()
+
+	first := flow.Run().Record("session-1", nil)
+	first.Advance("submit")
+	second := flow.FindByID(first.State().ID).Run().Record("session-1", nil)
+	second.Advance("review")
+	second.Advance("approve")
+
+	merged, err := MergeTapes(first.Log(), nil, second.Log())
+	if err != nil {
+		t.Fatalf("unexpected error merging contiguous tapes: %v", err)
+	}
+	if len(merged) != 3 || merged[0].From != flow.ID || merged[2].To != second.State().ID {
+		t.Errorf("expected the whole run, got %v", merged)
+	}
+
+	restarted := flow.Run().Record("session-1", nil)
+	restarted.Advance("submit")
+	if _, err := MergeTapes(first.Log(), restarted.Log()); err == nil || !strings.Contains(err.Error(), "segment 1 starts at state 1 rather than state 2") {
+		t.Errorf("expected discontinuity to be rejected, got %v", err)
+	}
+	other := flow.FindByID(first.State().ID).Run().Record("session-2", nil)
+	other.Advance("review")
+	if _, err := MergeTapes(first.Log(), other.Log()); err == nil {
+		t.Errorf("expected tapes of different sessions to be rejected")
+	}
+}
+
+func TestOnce(t *testing.T) {
+	flow := Once(a).THEN(a.OR(b)).Build()
+
+	run := flow.Run()
+	for _, event := range []string{A, A, A} {
+		run.Advance(event)
+	}
+	if run.State().Finished() {
+		t.Errorf("expected repeated A events to be ignored")
+	}
+	if state, _ := run.Advance(B); !state.Finished() {
+		t.Errorf("expected other events to advance the run")
+	}
+
+	if !flow.Advance(A).Advance(A).Finished() {
+		t.Errorf("expected State.Advance not to track satisfied tests")
+	}
+	if state, _ := flow.Run().Advance(A); state == flow {
+		t.Errorf("expected satisfied tests to be tracked per run")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+   BuildStable builds the flow the same as Build, except that the ID of each
+   State is derived from its content rather than from the order in which
+   the flow was defined.  Definitions that differ only in the order of the
+   branches of their ORs and ANDs then give matching States the same IDs,
+   so that IDs saved while running one definition can be used to resume
+   runs on another (see FindByID).
+
+   Each State is identified by its path from the root, which is the sequence
+   of names of the Tests along the way (see NamedTest).  Where several paths
+   lead to a State, as they do to the ends of ORs and ANDs, the one whose
+   names come first in lexical order is used.  The ID is a 31-bit hash of
+   the path, so saved IDs remain valid as long as the paths to the States
+   they identify are unchanged, however the rest of the flow changes.
+
+   Should the paths of two States hash to the same ID, the State whose path
+   comes first in lexical order keeps it, and the other takes the next
+   unused ID.  Such a collision ties the IDs of both States to the presence
+   of the other, so it's the one case in which adding a State can change the
+   ID of an unrelated one.  BuildStable returns an error if a Test has
+   neither a name nor a key (see Keyer), since its name wouldn't survive a
+   restart, or if two States have the same path, in which case they can't
+   be told apart.
+*/
+func (state *State) BuildStable() (*State, error) {
+	root := state.root()
+	paths, err := root.stablePaths()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]*State, 0, len(paths))
+	for s := range paths {
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return comparePaths(paths[states[i]], paths[states[j]]) < 0
+	})
+	used := make(map[int]bool, len(states))
+	for i, s := range states {
+		if i > 0 && comparePaths(paths[states[i-1]], paths[s]) == 0 {
+			return nil, fmt.Errorf("two states have the same path %q", strings.Join(paths[s], " -> "))
+		}
+		id := hashPath(paths[s])
+		for used[id] {
+			id = id%0x7fffffff + 1
+		}
+		used[id] = true
+		s.ID = id
+	}
+	return root.finishBuild(), nil
+}
+
+// stablePaths finds the path used by BuildStable for each State of the flow
+// starting at the given root, visiting the States in topological order so
+// that every path to a State is known before the State is left.
+func (root *State) stablePaths() (map[*State][]string, error) {
+	pending := make(map[*State]int)
+	root.each(func(s *State) {
+		pending[s] = len(s.in)
+	})
+	paths := map[*State][]string{root: nil}
+	ready := []*State{root}
+	for len(ready) > 0 {
+		current := ready[len(ready)-1]
+		ready = ready[:len(ready)-1]
+		for _, trans := range current.out {
+			name := stableName(trans)
+			if name == "" {
+				return nil, fmt.Errorf("test after %q has neither a name nor a key", strings.Join(paths[current], " -> "))
+			}
+			path := append(append([]string(nil), paths[current]...), name)
+			if existing, ok := paths[trans.to]; !ok || comparePaths(path, existing) < 0 {
+				paths[trans.to] = path
+			}
+			pending[trans.to]--
+			if pending[trans.to] == 0 {
+				ready = append(ready, trans.to)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// stableName names the given transition in the paths used by BuildStable,
+// or returns "" if its Test has neither a name nor a key.
+func stableName(trans *transition) string {
+	switch {
+	case trans.epsilon:
+		return "(epsilon)"
+	case trans.test.isZero():
+		// The link from the start to the end of a lazily evaluated AND
+		return "(lazy)"
+	}
+	return label(trans.test)
+}
+
+// comparePaths compares the given paths in lexical order of their names,
+// returning a negative number, 0 or a positive number.
+func comparePaths(path, other []string) int {
+	for i := 0; i < len(path) && i < len(other); i++ {
+		if c := strings.Compare(path[i], other[i]); c != 0 {
+			return c
+		}
+	}
+	return len(path) - len(other)
+}
+
+// hashPath hashes the given path to a positive 31-bit ID.
+func hashPath(path []string) int {
+	h := fnv.New32a()
+	for _, name := range path {
+		// Prefix each name with its length so that names can't run together
+		h.Write([]byte(strconv.Itoa(len(name)) + ":" + name))
+	}
+	id := int(h.Sum32() & 0x7fffffff)
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
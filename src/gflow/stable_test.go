@@ -0,0 +1,108 @@
+package gflow
+
+import (
+	"strings"
+	"testing"
+)
+
+var submit Test = NamedTest("submit", a)
+var approve Test = NamedTest("approve", b)
+var reject Test = NamedTest("reject", c)
+var notify Test = NamedTest("notify", d)
+
+func TestBuildStable(t *testing.T) {
+	definitions := []*State{
+		submit.THEN(approve.OR(reject)).THEN(notify),
+		submit.THEN(reject.OR(approve)).THEN(notify),
+		submit.THEN(reject.OR(approve).THEN(notify.state())),
+	}
+	flows := make([]*State, len(definitions))
+	for i, definition := range definitions {
+		flow, err := definition.BuildStable()
+		if err != nil {
+			t.Fatalf("unexpected error building definition %d: %v", i, err)
+		}
+		flows[i] = flow
+	}
+
+	// Start a run on the first definition and resume it on the others
+	saved := flows[0].Advance(A).Advance(C).ID
+	for i, flow := range flows[1:] {
+		resumed := flow.FindByID(saved)
+		if resumed == nil || resumed != flow.Advance(A).Advance(C) {
+			t.Fatalf("expected saved ID to find the same position in definition %d", i+1)
+		}
+		if !resumed.Advance(D).Finished() {
+			t.Errorf("expected resumed run to finish on definition %d", i+1)
+		}
+	}
+	if flows[0].Advance(A).Advance(B).ID != flows[1].Advance(A).Advance(B).ID {
+		t.Errorf("expected the shared end of the OR to have the same ID")
+	}
+
+	and, err := submit.AND(approve).BuildStable()
+	if err != nil {
+		t.Fatalf("unexpected error building AND: %v", err)
+	}
+	reversed, _ := approve.AND(submit).BuildStable()
+	if and.Advance(B).ID != reversed.Advance(B).ID || and.Advance(B).Advance(A).ID != reversed.Advance(A).Advance(B).ID {
+		t.Errorf("expected the branches of an AND to be identified regardless of order")
+	}
+}
+
+func TestBuildStableKeepsIDs(t *testing.T) {
+	flow, err := submit.THEN(approve.OR(reject)).THEN(notify).BuildStable()
+	if err != nil {
+		t.Fatalf("unexpected error building flow: %v", err)
+	}
+	ids := flow.InDegrees()
+
+	encoded, err := EncodeFlow(flow, nil)
+	if err != nil {
+		t.Fatalf("unable to encode flow: %s", err)
+	}
+	names := map[string]Test{"submit": submit, "approve": approve, "reject": reject, "notify": notify}
+	decoded, err := DecodeFlow(encoded, names)
+	if err != nil {
+		t.Fatalf("unable to decode %s: %s", encoded, err)
+	}
+	if decoded.ID != flow.ID || decoded.Advance(A).Advance(C).ID != flow.Advance(A).Advance(C).ID || len(decoded.InDegrees()) != len(ids) {
+		t.Errorf("expected decoded flow to keep the stable IDs %v, got %v", ids, decoded.InDegrees())
+	}
+
+	afterSubmit := flow.Advance(A)
+	stableID := afterSubmit.ID
+	flow.CountEntries()
+	if afterSubmit.ID != stableID || flow.FindByID(stableID) != afterSubmit {
+		t.Fatalf("expected counting entries to keep the stable IDs")
+	}
+	flow.Advance(A).Advance(B)
+	counts := flow.EntryCounts()
+	if len(counts) != len(ids) || counts[afterSubmit.ID] != 1 {
+		t.Errorf("expected entries to be counted by stable ID, got %v", counts)
+	}
+	for id := range counts {
+		if _, ok := ids[id]; !ok {
+			t.Errorf("expected only stable IDs to be counted, got %d", id)
+		}
+	}
+}
+
+func TestBuildStableErrors(t *testing.T) {
+	if _, err := submit.THEN(a).BuildStable(); err == nil || !strings.Contains(err.Error(), `after "submit"`) {
+		t.Errorf("expected unnamed test to be reported, got %v", err)
+	}
+	builder := NewFlowBuilder()
+	builder.AddTransition(builder.Root(), builder.AddState(), submit)
+	builder.AddTransition(builder.Root(), builder.AddState(), submit)
+	flow, _ := builder.Build()
+	if _, err := flow.BuildStable(); err == nil || !strings.Contains(err.Error(), "same path") {
+		t.Errorf("expected states with the same path to be reported, got %v", err)
+	}
+}
+
+func TestHashPath(t *testing.T) {
+	if hashPath(nil) == hashPath([]string{""}) || hashPath([]string{"ab"}) == hashPath([]string{"a", "b"}) {
+		t.Errorf("expected different paths to hash differently")
+	}
+}
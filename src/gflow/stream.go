@@ -0,0 +1,41 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"context"
+)
+
+// AdvanceStream advances from the given State with each event received from
+// in, sending the resulting State to out after each event, whether or not
+// the event triggered a transition.  It returns once in is closed or the flow
+// finishes, closing out.  Since each State is sent before the next event is
+// received, a slow consumer of out holds back the consumption of in.
+func (state *State) AdvanceStream(in <-chan EventData, out chan<- *State) {
+	state.AdvanceStreamContext(context.Background(), in, out)
+}
+
+// AdvanceStreamContext advances the same as AdvanceStream, but also stops
+// once the given context is done, in which case it returns the context's
+// error.  It returns nil once in is closed or the flow finishes.
+func (state *State) AdvanceStreamContext(ctx context.Context, in <-chan EventData, out chan<- *State) error {
+	defer close(out)
+	for !state.Finished() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case data, ok := <-in:
+			if !ok {
+				return nil
+			}
+			state = state.Advance(data)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- state:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package gflow
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAdvanceStream(t *testing.T) {
+	flow := a.THEN(b).THEN(c).Build()
+	in := make(chan EventData)
+	out := make(chan *State)
+	go flow.AdvanceStream(in, out)
+
+	var states []*State
+	for _, event := range []string{A, D, B, C} {
+		in <- event
+		states = append(states, <-out)
+	}
+	if _, ok := <-out; ok {
+		t.Errorf("expected out to be closed once the flow finished")
+	}
+
+	expected := []*State{flow.Advance(A), flow.Advance(A), flow.Advance(A).Advance(B), flow.Advance(A).Advance(B).Advance(C)}
+	for i, state := range states {
+		if state != expected[i] {
+			t.Errorf("expected state %d to have ID %d, got %d", i, expected[i].ID, state.ID)
+		}
+	}
+}
+
+func TestAdvanceStreamClosed(t *testing.T) {
+	in := make(chan EventData, 1)
+	out := make(chan *State, 1)
+	in <- A
+	close(in)
+	a.THEN(b).Build().AdvanceStream(in, out)
+	if state := <-out; state.Finished() {
+		t.Errorf("expected flow to stop part way through")
+	}
+	if _, ok := <-out; ok {
+		t.Errorf("expected out to be closed once in was closed")
+	}
+}
+
+func TestAdvanceStreamContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan EventData)
+	out := make(chan *State)
+	done := make(chan error)
+	go func() {
+		done <- a.THEN(b).Build().AdvanceStreamContext(ctx, in, out)
+	}()
+
+	// Leave the State unconsumed, so the stream is blocked on out
+	in <- A
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected cancellation error, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+// Case is a branch of a SWITCH, taken when the first event passes Test.  A
+// nil Flow leads straight to the tail of the SWITCH.
+type Case struct {
+	Test Test
+	Flow stateSource
+}
+
+/*
+   SWITCH constructs a flow that chooses one of the given cases based on the
+   first event and then, once the flow of that case is finished, continues
+   with the given tail, which all of the cases share.  Unlike an OR of
+   branches that each end in a copy of the tail, the tail appears in the
+   flow only once.
+
+   The first event is tested against the cases in the order given, and only
+   the first case whose Test passes is taken, unless Build orders the Tests
+   differently by cost (see Coster).  Cases are given as a slice rather than
+   keyed by Test so that this order is well defined.  Each case is linked to
+   the tail with an epsilon transition (see EPSILON), so a run that finishes
+   the flow of a case is at the end of that flow and at the start of the
+   tail at the same time.  With no cases, SWITCH returns a copy of the tail.
+*/
+func SWITCH(cases []Case, tail stateSource) *State {
+	start := new(State)
+	tailState := tail.state().copy()
+	tailRoot := tailState.root()
+	for _, c := range cases {
+		branch := c.Test.state()
+		if c.Flow != nil {
+			branch = branch.THEN(c.Flow)
+		}
+		for _, trans := range branch.root().out {
+			start.addOut(trans)
+		}
+		link := &transition{epsilon: true}
+		branch.addOut(link)
+		tailRoot.addIn(link)
+	}
+	return tailState
+}
@@ -0,0 +1,34 @@
+package gflow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSWITCH(t *testing.T) {
+	var tailFired int
+	tail := c.THEN(d).DO(func(data EventData) {
+		tailFired++
+	})
+	flow := SWITCH([]Case{{a, b}, {b, nil}, {Always, a.THEN(a)}}, tail).Build()
+
+	for _, sequence := range [][]string{{A, B, C, D}, {B, C, D}, {D, A, A, C, D}} {
+		if !finishes(flow, sequence) {
+			t.Errorf("expected %s to finish through its case into the tail", sequence)
+		}
+	}
+	if tailFired != 3 {
+		t.Errorf("expected tail actions to fire once per run, fired %d times", tailFired)
+	}
+	for _, sequence := range [][]string{{A, C, D}, {A, B}, {C, A, A}} {
+		if finishes(flow, sequence) {
+			t.Errorf("expected %s not to finish", sequence)
+		}
+	}
+	if !finishes(flow, []string{A, B, C, D}) || finishes(flow, []string{A, A, A, C, D}) {
+		t.Errorf("expected only the first passing case to be taken")
+	}
+	if dump := flow.Canonical(); strings.Count(dump, "t4 -> ") != 1 {
+		t.Errorf("expected the tail to appear once, got\n%s", dump)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timestamped is implemented by EventData that carries the time at which the
+// event occurred, which Runners use in preference to their Clock to time how
+// long a run has been at the State the event moved it to (see
+// Runner.AdvanceClock).
+type Timestamped interface {
+	Time() time.Time
+}
+
+// Clock returns the current time.  Features that need the time accept a
+// Clock so that tests can control it, defaulting to time.Now.
+type Clock func() time.Time
+
+// EventTime returns the time at which the event represented by the given
+// EventData occurred, if known.  EventData implementing Timestamped provides
+// its own time.  For EventData of type map[string]interface{}, the time is
+// taken from the given field, which may hold either a time.Time or a
+// Timestamped value.
+func EventTime(data EventData, field string) (time.Time, bool) {
+	if timestamped, ok := data.(Timestamped); ok {
+		return timestamped.Time(), true
+	}
+	if fields, ok := data.(map[string]interface{}); ok {
+		switch value := fields[field].(type) {
+		case time.Time:
+			return value, true
+		case Timestamped:
+			return value.Time(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Timeout returns a Test for transitions that are taken once a run has been
+// at the transition's State for at least the given duration, rather than in
+// response to an event.  Only Runners take such transitions, when the client
+// program calls Runner.AdvanceClock, and the Test itself rejects every event.
+// For example, a.THEN(b.OR(Timeout(30 * time.Second).THEN(c))) waits up to 30
+// seconds after A for B before moving on to wait for C.
+//
+// A run inside a lazily evaluated AND or a barrier is timed from when it last
+// advanced any of the branches, not from when it reached the current
+// position of each branch.
+func Timeout(after time.Duration) Test {
+	return Describe(NewTest(func(data EventData) bool {
+		waited, ok := data.(waitedFor)
+		return ok && time.Duration(waited) >= after
+	}), timeout{after})
+}
+
+/*
+   TIMEOUT constructs a flow that continues with the flow ending in from,
+   unless from goes without advancing for the given duration, in which case
+   it continues with to instead.  It's the same as from.XOR(Timeout(after).
+   THEN(to)), so b.TIMEOUT(30*time.Second, c) waits up to 30 seconds for B
+   and then only for C.  Once from advances, the timeout no longer applies.
+
+   As with Timeout, only Runners take the transition that times out, when
+   the client program calls Runner.AdvanceClock or sends Runner.Advance a
+   TickEvent, since only a Runner keeps track of how long its run has been
+   waiting.
+*/
+func (from *State) TIMEOUT(after time.Duration, to stateSource) *State {
+	return from.XOR(Timeout(after).THEN(to))
+}
+
+func (from Test) TIMEOUT(after time.Duration, to stateSource) *State {
+	return from.state().TIMEOUT(after, to)
+}
+
+// waitedFor is how long a run has been at its current State, which
+// AdvanceClock passes to Timeouts in place of an event.  Being unexported,
+// no event sent by a client program can pass a Timeout.
+type waitedFor time.Duration
+
+type timeout struct {
+	after time.Duration
+}
+
+func (desc timeout) Key() string {
+	return fmt.Sprintf("Timeout(%s)", desc.after)
+}
+
+func (desc timeout) Pure() bool {
+	return true
+}
+
+// timeoutAfter returns the duration after which the given Test times out, if
+// it's a Timeout.
+func timeoutAfter(test Test) (time.Duration, bool) {
+	desc, ok := describe(test).(timeout)
+	return desc.after, ok
+}
+
+// SLA sets a deadline by which runs through the flow containing the given
+// State must finish, measured from when each run starts (see
+// Runner.SLABreached).  The deadline belongs to the root of the flow, so it
+// should be set once the flow is complete.  Combining the flow using OR or
+// AND, or continuing another flow with it using THEN, drops the deadline.
+func (state *State) SLA(deadline time.Duration) *State {
+	state.root().sla = deadline
+	return state
+}
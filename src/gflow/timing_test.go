@@ -0,0 +1,215 @@
+package gflow
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2011, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type timedEvent struct {
+	name string
+	at   time.Time
+}
+
+func (event timedEvent) Time() time.Time {
+	return event.at
+}
+
+func TestEventTime(t *testing.T) {
+	if at, ok := EventTime(timedEvent{A, epoch}, ""); !ok || !at.Equal(epoch) {
+		t.Errorf("expected time of Timestamped event")
+	}
+	later := epoch.Add(time.Minute)
+	if at, ok := EventTime(map[string]interface{}{"at": later}, "at"); !ok || !at.Equal(later) {
+		t.Errorf("expected time from map field")
+	}
+	if at, ok := EventTime(map[string]interface{}{"at": timedEvent{A, later}}, "at"); !ok || !at.Equal(later) {
+		t.Errorf("expected time from Timestamped map field")
+	}
+	if _, ok := EventTime(map[string]interface{}{"at": "noon"}, "at"); ok {
+		t.Errorf("expected no time from map field of the wrong type")
+	}
+	if _, ok := EventTime(A, "at"); ok {
+		t.Errorf("expected no time for plain string event")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	now := epoch
+	clock := func() time.Time {
+		return now
+	}
+	var timedOutAt EventData
+	flow := a.THEN(b.OR(Timeout(30 * time.Second).THEN(c).OR(Timeout(time.Minute).THEN(d)))).Build()
+
+	run := flow.Run().Clock(clock)
+	now = now.Add(time.Hour)
+	if run.AdvanceClock() != flow {
+		t.Errorf("expected root without timeouts to ignore the clock")
+	}
+	run.Advance(A)
+	waiting := run.State()
+	waiting.Advance(B)
+
+	now = now.Add(29 * time.Second)
+	if run.AdvanceClock() != waiting {
+		t.Errorf("expected state not to time out before its timeout")
+	}
+	now = now.Add(2 * time.Minute)
+	timedOut := run.AdvanceClock()
+	if timedOut == waiting || timedOut.Finished() {
+		t.Fatalf("expected state to time out")
+	}
+	if timedOut.Advance(D).Finished() || !timedOut.Advance(C).Finished() {
+		t.Errorf("expected shortest overdue timeout to be taken")
+	}
+
+	run = flow.Run().Clock(clock)
+	run.Advance(A)
+	now = now.Add(time.Minute)
+	run.Advance(B)
+	if !run.State().Finished() {
+		t.Errorf("expected event to advance before timing out")
+	}
+
+	delayed := a.THEN(Timeout(time.Second).state().DO(func(data EventData) {
+		timedOutAt = data
+	})).Build()
+	run = delayed.Run().Clock(clock)
+	run.Advance(A)
+	now = now.Add(time.Second)
+	if !run.AdvanceClock().Finished() || timedOutAt != now {
+		t.Errorf("expected timeout action to be handed the time, got %v", timedOutAt)
+	}
+}
+
+func TestTimeoutEventTime(t *testing.T) {
+	clock := func() time.Time {
+		return epoch
+	}
+	flow := Always.THEN(b.OR(Timeout(time.Minute).THEN(c))).Build()
+	run := flow.Run().Clock(clock)
+	waiting, _ := run.Advance(timedEvent{A, epoch.Add(-2 * time.Minute)})
+	if run.AdvanceClock() == waiting {
+		t.Errorf("expected state to be timed from when the event that reached it occurred")
+	}
+
+	run = flow.Run().Clock(clock)
+	run.Advance(A)
+	if run.AdvanceClock() != waiting {
+		t.Errorf("expected state reached by an event without a time to be timed by the clock")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	occurred := func(name string) Test {
+		return NewTest(func(data EventData) bool {
+			event, ok := data.(timedEvent)
+			return ok && event.name == name
+		})
+	}
+	flow := occurred(A).AND(occurred(B)).THEN(occurred(C)).Build()
+
+	run := flow.Run().Window(time.Minute)
+	run.Advance(timedEvent{B, epoch.Add(30 * time.Second)})
+	if _, err := run.Advance(timedEvent{A, epoch}); err != nil {
+		t.Errorf("expected event within the window to be accepted, got %v", err)
+	}
+	run.Advance(timedEvent{C, epoch.Add(time.Minute)})
+	if !run.State().Finished() {
+		t.Errorf("expected AND to handle events that arrived out of order within the window")
+	}
+
+	run = flow.Run().Window(time.Minute)
+	waiting, _ := run.Advance(timedEvent{B, epoch.Add(2 * time.Minute)})
+	if state, err := run.Advance(timedEvent{A, epoch}); err != ErrOutOfOrder || state != waiting {
+		t.Errorf("expected event before the window to be rejected, got %v", err)
+	}
+
+	run = flow.Run()
+	run.Advance(timedEvent{B, epoch.Add(2 * time.Minute)})
+	if _, err := run.Advance(timedEvent{A, epoch}); err != nil || run.State() == waiting {
+		t.Errorf("expected events not to be checked for order without a window, got %v", err)
+	}
+}
+
+func TestSLA(t *testing.T) {
+	now := epoch
+	clock := func() time.Time {
+		return now
+	}
+	flow := a.THEN(b).THEN(c).SLA(24 * time.Hour).Build()
+
+	run := flow.Run().Clock(clock)
+	run.Advance(A)
+	if run.SLABreached(epoch.Add(24 * time.Hour)) {
+		t.Errorf("expected no breach at the deadline")
+	}
+	if !run.SLABreached(epoch.Add(25 * time.Hour)) {
+		t.Errorf("expected breach after the deadline")
+	}
+	if a.THEN(b).Build().Run().SLABreached(epoch.Add(1000 * time.Hour)) {
+		t.Errorf("expected no breach without a deadline")
+	}
+
+	now = epoch.Add(time.Hour)
+	run.FailOnSLA("late")
+	if run.AdvanceClock().Finished() {
+		t.Errorf("expected run not to fail before the deadline")
+	}
+	now = epoch.Add(25 * time.Hour)
+	failed := run.AdvanceClock()
+	if outcome, _ := failed.OutcomeName(); !failed.Finished() || outcome != "late" {
+		t.Errorf("expected breached run to fail with outcome, got %q", outcome)
+	}
+
+	finished := flow.Run().Clock(clock)
+	finished.Advance(A)
+	finished.Advance(B)
+	finished.Advance(C)
+	if finished.SLABreached(epoch.Add(1000 * time.Hour)) {
+		t.Errorf("expected finished run never to breach")
+	}
+}
+
+func TestTIMEOUT(t *testing.T) {
+	now := epoch
+	clock := func() time.Time {
+		return now
+	}
+	flow := a.THEN(b.TIMEOUT(30*time.Second, c)).Build()
+
+	run := flow.Run().Clock(clock)
+	run.Advance(A)
+	waiting := run.State()
+	if state, err := run.Advance(TickEvent(now.Add(29 * time.Second))); err != nil || state != waiting {
+		t.Errorf("expected state not to time out before its timeout")
+	}
+	state, err := run.Advance(TickEvent(now.Add(31 * time.Second)))
+	if err != nil || state == waiting || state.Finished() {
+		t.Fatalf("expected state to time out")
+	}
+	if state.Advance(B).Finished() || !state.Advance(C).Finished() {
+		t.Errorf("expected timed out state to wait for c")
+	}
+
+	run = flow.Run().Clock(clock)
+	run.Advance(A)
+	now = now.Add(10 * time.Second)
+	run.Advance(B)
+	if !run.State().Finished() {
+		t.Errorf("expected event to advance before timing out")
+	}
+
+	chained := a.THEN(b.TIMEOUT(30*time.Second, c.TIMEOUT(30*time.Second, d))).Build()
+	run = chained.Run().Clock(clock)
+	run.Advance(A)
+	first, _ := run.Advance(TickEvent(now.Add(31 * time.Second)))
+	if state, _ := run.Advance(TickEvent(now.Add(45 * time.Second))); state != first {
+		t.Errorf("expected timed out state to be timed from the tick that reached it")
+	}
+	if state, _ := run.Advance(TickEvent(now.Add(62 * time.Second))); state == first || !state.Advance(D).Finished() {
+		t.Errorf("expected timed out state to time out in turn")
+	}
+}
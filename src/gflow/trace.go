@@ -0,0 +1,39 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+// Tracer is notified of the transitions taken by AdvanceTraced, for example
+// to audit the path that a sequence of events takes through a flow.
+type Tracer interface {
+	// OnTransition is called once the given EventData has triggered a
+	// transition from one State to another and the actions of the State it
+	// leads to have fired.
+	OnTransition(from, to *State, data EventData)
+}
+
+// AdvanceTraced advances the same as Advance and, if the event triggers a
+// transition, reports it to the given Tracer.  Events that are ignored
+// aren't reported.
+func (state *State) AdvanceTraced(data EventData, tracer Tracer) *State {
+	next, advanced := state.AdvanceE(data)
+	if advanced {
+		tracer.OnTransition(state, next, data)
+	}
+	return next
+}
+
+// SliceTracer is a Tracer that records the IDs of the States visited by the
+// transitions reported to it, starting with the State that the first of
+// them left, so that the path can be persisted.  Positions inside a lazily
+// evaluated AND have no ID and are recorded as 0.
+type SliceTracer struct {
+	IDs []int
+}
+
+func (tracer *SliceTracer) OnTransition(from, to *State, data EventData) {
+	if len(tracer.IDs) == 0 {
+		tracer.IDs = append(tracer.IDs, from.ID)
+	}
+	tracer.IDs = append(tracer.IDs, to.ID)
+}
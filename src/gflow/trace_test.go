@@ -0,0 +1,27 @@
+package gflow
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAdvanceTraced(t *testing.T) {
+	flow := a.THEN(b).THEN(c).Build()
+	tracer := new(SliceTracer)
+	state := flow
+	for _, event := range []string{A, B, C} {
+		state = state.AdvanceTraced(event, tracer)
+	}
+	if !state.Finished() || !reflect.DeepEqual(tracer.IDs, []int{1, 2, 3, 4}) {
+		t.Errorf("expected path 1, 2, 3, 4, got %v", tracer.IDs)
+	}
+}
+
+func TestAdvanceTracedIgnored(t *testing.T) {
+	flow := a.THEN(b).OR(c).Build()
+	tracer := new(SliceTracer)
+	state := flow.AdvanceTraced(D, tracer).AdvanceTraced(A, tracer).AdvanceTraced(A, tracer)
+	if state != flow.Advance(A) || !reflect.DeepEqual(tracer.IDs, []int{1, 2}) {
+		t.Errorf("expected only the transition taken to be traced, got %v", tracer.IDs)
+	}
+}
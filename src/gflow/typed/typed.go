@@ -0,0 +1,136 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+// Package typed provides a type-safe API for gflow flows whose events are
+// all of the same type, so that Tests and Actions receive events of that
+// type rather than asserting the type of an EventData.  It's kept apart from
+// package gflow, whose API remains the same, and requires a version of Go
+// with type parameters.
+//
+// Flows built here are ordinary gflow flows underneath (see Flow.State), and
+// behave exactly the same.  For example
+//
+//   type Order struct {
+//       Status string
+//   }
+//
+//   paid := typed.NewTest(func(order Order) bool { return order.Status == "paid" })
+//   shipped := typed.NewTest(func(order Order) bool { return order.Status == "shipped" })
+//   flow := paid.THEN(shipped).Build()
+//   state := flow.Advance(Order{Status: "paid"})
+//
+// where passing anything other than an Order to Advance doesn't compile.
+package typed
+
+import (
+	"gflow"
+)
+
+// Test is a gflow.Test for events of type T.  Like gflow.Test, it can be
+// compared with ==, so that the same Test is recognized as such wherever
+// it's used, which OR relies on to merge transitions with the same Test.
+// Create Tests with NewTest.
+type Test[T any] struct {
+	test gflow.Test
+}
+
+// Action is a gflow.Action for events of type T.
+type Action[T any] func(event T)
+
+// Flow is a gflow flow whose events are of type T, referenced by one of its
+// States, the same as flows in package gflow.
+type Flow[T any] struct {
+	state *gflow.State
+}
+
+// Source is either a Test or a Flow for events of type T, which the
+// operators accept interchangeably, the same as in package gflow.
+type Source[T any] interface {
+	flow() Flow[T]
+}
+
+// NewTest creates a Test from the given function.  Events that aren't of
+// type T, which only reach the Test if its flow is also advanced through
+// package gflow, fail it.
+func NewTest[T any](test func(event T) bool) Test[T] {
+	return Test[T]{gflow.NewTest(func(data gflow.EventData) bool {
+		event, ok := data.(T)
+		return ok && test(event)
+	})}
+}
+
+// Untyped returns the gflow.Test underlying the given Test.
+func (test Test[T]) Untyped() gflow.Test {
+	return test.test
+}
+
+func (test Test[T]) flow() Flow[T] {
+	return Flow[T]{new(gflow.State).THEN(test.test)}
+}
+
+func (test Test[T]) THEN(next Source[T]) Flow[T] {
+	return test.flow().THEN(next)
+}
+
+func (test Test[T]) OR(other Source[T]) Flow[T] {
+	return test.flow().OR(other)
+}
+
+func (test Test[T]) AND(other Source[T]) Flow[T] {
+	return test.flow().AND(other)
+}
+
+func (flow Flow[T]) flow() Flow[T] {
+	return flow
+}
+
+// THEN is the same as gflow.State.THEN.
+func (flow Flow[T]) THEN(next Source[T]) Flow[T] {
+	return Flow[T]{flow.state.THEN(next.flow().state)}
+}
+
+// OR is the same as gflow.State.OR.
+func (flow Flow[T]) OR(other Source[T]) Flow[T] {
+	return Flow[T]{flow.state.OR(other.flow().state)}
+}
+
+// AND is the same as gflow.State.AND.
+func (flow Flow[T]) AND(other Source[T]) Flow[T] {
+	return Flow[T]{flow.state.AND(other.flow().state)}
+}
+
+// DO is the same as gflow.State.DO.  Events that aren't of type T, which
+// only reach the action if the flow is also advanced through package gflow,
+// are passed to it as the zero value of T.
+func (flow Flow[T]) DO(action Action[T]) Flow[T] {
+	return Flow[T]{flow.state.DO(func(data gflow.EventData) {
+		event, _ := data.(T)
+		action(event)
+	})}
+}
+
+// Build is the same as gflow.State.Build.
+func (flow Flow[T]) Build() Flow[T] {
+	return Flow[T]{flow.state.Build()}
+}
+
+// Advance is the same as gflow.State.Advance.
+func (flow Flow[T]) Advance(event T) Flow[T] {
+	return Flow[T]{flow.state.Advance(event)}
+}
+
+// Finished is the same as gflow.State.Finished.
+func (flow Flow[T]) Finished() bool {
+	return flow.state.Finished()
+}
+
+// ID returns the ID of the State by which the flow is referenced.
+func (flow Flow[T]) ID() int {
+	return flow.state.ID
+}
+
+// State returns the gflow.State by which the flow is referenced, giving
+// access to the rest of the gflow API.
+func (flow Flow[T]) State() *gflow.State {
+	return flow.state
+}
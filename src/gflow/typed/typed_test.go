@@ -0,0 +1,66 @@
+package typed
+
+import (
+	"testing"
+)
+
+type order struct {
+	Status string
+	Amount int
+}
+
+func status(s string) Test[order] {
+	return NewTest(func(o order) bool {
+		return o.Status == s
+	})
+}
+
+var placed = status("placed")
+var paid = status("paid")
+var shipped = status("shipped")
+var cancelled = status("cancelled")
+
+func TestTHEN(t *testing.T) {
+	var total int
+	flow := placed.THEN(paid).THEN(shipped).DO(func(o order) {
+		total += o.Amount
+	}).Build()
+
+	state := flow.Advance(order{Status: "placed"}).Advance(order{Status: "shipped"})
+	if state.ID() != flow.Advance(order{Status: "placed"}).ID() {
+		t.Errorf("expected out of order event to be ignored")
+	}
+	state = state.Advance(order{Status: "paid"}).Advance(order{Status: "shipped", Amount: 5})
+	if !state.Finished() || total != 5 {
+		t.Errorf("expected flow to finish and pass the typed event to its action, got %d", total)
+	}
+}
+
+func TestORAND(t *testing.T) {
+	flow := placed.THEN(paid.AND(shipped)).OR(cancelled).Build()
+	if !flow.Advance(order{Status: "cancelled"}).Finished() {
+		t.Errorf("expected cancelled to finish the flow")
+	}
+	state := flow.Advance(order{Status: "placed"}).Advance(order{Status: "shipped"}).Advance(order{Status: "paid"})
+	if !state.Finished() {
+		t.Errorf("expected paid and shipped in either order to finish the flow")
+	}
+}
+
+func TestSameTest(t *testing.T) {
+	flow := placed.THEN(paid).OR(placed.THEN(shipped)).Build()
+	state := flow.Advance(order{Status: "placed"})
+	if !state.Advance(order{Status: "shipped"}).Finished() || !state.Advance(order{Status: "paid"}).Finished() {
+		t.Errorf("expected OR to merge the transitions of the shared Test")
+	}
+}
+
+func TestUntyped(t *testing.T) {
+	flow := placed.THEN(paid).Build()
+	if flow.State().Advance("placed") != flow.State() {
+		t.Errorf("expected events of the wrong type to fail typed Tests")
+	}
+	if !placed.Untyped().Pass(order{Status: "placed"}) {
+		t.Errorf("expected untyped Test to pass events of the right type")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2011 Percy Wegmann. All rights reserved.
+// Use of this source code is governed by the BSD license found in LICENSE.
+
+package gflow
+
+/*
+   XOR constructs a conditional flow which terminates when exactly one of
+   state and other is reached.  The first event that advances either branch
+   commits the flow to that branch, after which the other branch can no
+   longer be advanced.  OR instead keeps the transitions of both branches
+   available until one of them finishes.
+
+   Where both branches start with the same Test, OR merges their leading
+   transitions so that the flow can continue along either branch after the
+   shared Test passes.  XOR never merges them.  Each branch is copied whole,
+   and the transitions out of its root are moved to the common start as they
+   are, so the start of a.THEN(b).XOR(a.THEN(c)) has two transitions for a.
+   Advance takes only the first of them (see Build), so an A commits that
+   flow to a.THEN(b), and it can only finish on B.
+
+   As with OR, a branch that finishes with an outcome keeps an end of its
+   own.  Unlike OR, XOR is not commutative when its branches share a leading
+   Test, since the order of the branches decides which of them an event
+   passing that Test commits the flow to.
+*/
+func (state *State) XOR(other stateSource) *State {
+	// Create a common start node
+	start := new(State)
+	// Create a common end node
+	end := new(State)
+
+	start.kind, end.kind = KindXORStart, KindXOREnd
+	for _, branch := range []*State{state, other.state()} {
+		branchEnd := branch.eager().copy()
+		for _, trans := range branchEnd.root().out {
+			start.addOut(trans)
+		}
+		if branchEnd.outcome == "" {
+			for _, trans := range branchEnd.in {
+				// Switch the transition to terminate at the end state
+				end.addIn(trans)
+			}
+		}
+	}
+	return start.joinEnds(end)
+}
+
+func (test Test) XOR(other stateSource) *State {
+	return test.state().XOR(other)
+}
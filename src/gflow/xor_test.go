@@ -0,0 +1,48 @@
+package gflow
+
+import (
+	"testing"
+)
+
+func TestXOR(t *testing.T) {
+	flow := a.THEN(b).XOR(c.THEN(d))
+	if !finishes(flow, []string{A, B}) || !finishes(flow, []string{C, D}) {
+		t.Errorf("expected either branch to finish the flow")
+	}
+	if finishes(flow, []string{A, C, D}) || finishes(flow, []string{C, A, B}) {
+		t.Errorf("expected the first event to commit the flow to its branch")
+	}
+	if !finishes(a.THEN(b).OR(c.THEN(d)), []string{A, C, D}) {
+		t.Errorf("expected OR to keep the other branch available")
+	}
+	if built := flow.Build(); built.Advance(A).Advance(B) != built.Advance(C).Advance(D) {
+		t.Errorf("expected both branches to share the common end")
+	}
+}
+
+func TestXORSharedPrefix(t *testing.T) {
+	xor := a.THEN(b).XOR(a.THEN(c))
+	or := a.THEN(b).OR(a.THEN(c))
+	if !finishes(xor, []string{A, B}) || finishes(xor, []string{A, C}) {
+		t.Errorf("expected A to commit the XOR to its first branch")
+	}
+	if !finishes(or, []string{A, B}) || !finishes(or, []string{A, C}) {
+		t.Errorf("expected OR to merge the shared A")
+	}
+	if start := xor.Build(); len(start.out) != 2 || len(start.Advance(A).out) != 1 {
+		t.Errorf("expected the leading transitions not to be merged")
+	}
+}
+
+func TestXOROutcomes(t *testing.T) {
+	flow := a.Outcome("left").XOR(b.Outcome("right")).Build()
+	if left, _ := flow.Advance(A).OutcomeName(); left != "left" {
+		t.Errorf("expected left outcome, got %q", left)
+	}
+	if right, _ := flow.Advance(B).OutcomeName(); right != "right" {
+		t.Errorf("expected right outcome, got %q", right)
+	}
+	if flow.Kind() != KindXORStart {
+		t.Errorf("expected XOR start, got %v", flow.Kind())
+	}
+}